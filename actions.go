@@ -2,169 +2,203 @@ package main
 
 import (
 	"log"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/thiefmaster/controller/apis"
 	"github.com/thiefmaster/controller/comm"
-	"github.com/thiefmaster/controller/ddc"
 )
 
-func showFancyIntro(cmdChan chan<- comm.Command, delay time.Duration) {
-	for i := knob; i <= buttonBottomRight; i++ {
-		cmdChan <- comm.NewClearLEDCommand(i)
-	}
-	for i := LED5; i <= LED1; i++ {
-		cmdChan <- comm.NewClearLEDCommand(i)
-		time.Sleep(delay)
+// action is something that can be bound to a gesture in the keymap.
+type action struct {
+	// turn actions can only be bound to turn gestures and get the number of
+	// steps the knob was turned
+	turn bool
+	// any actions can be bound to all gestures
+	any bool
+	run func(state *appState, cmdChan chan<- comm.Command, value int)
+}
+
+var actionRegistry = map[string]action{
+	"lockDesktop": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		lockDesktop(state)
+	}},
+	"toggleMonitors": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		toggleMonitors(cmdChan, state)
+	}},
+	"switchAudioTarget": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		log.Println("switching audio target")
+		runIntegrationAction(state, "audio.next", 0, "audioSwitched")
+	}},
+	"showBehavior": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		showBehavior(state, cmdChan)
+	}},
+	"toggleDND": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		toggleDND(state)
+	}},
+	"cycleMode": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		cycleMode(state, cmdChan)
+	}},
+	"toggleTubeMode": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		toggleTubeMode(state, cmdChan)
+	}},
+	"foobarNext": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		log.Println("playing next song")
+		runIntegrationAction(state, "foobar.next", 0, "next")
+	}},
+	"next": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		state.mode().next(state, cmdChan)
+	}},
+	"togglePause": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		state.mode().togglePause(state)
+	}},
+	"stop": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		state.mode().stop(state)
+	}},
+	"volume": {turn: true, run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		state.mode().adjustVolume(state, value)
+	}},
+	"seek": {turn: true, run: seek},
+	"shutdown": {run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		log.Println("shutdown requested")
+		state.shutdown = true
+	}},
+}
+
+// parameterizedAction looks up an action which takes an argument, used as
+// `<action>:<argument>`.
+func (c *appConfig) parameterizedAction(name, arg string) (action, bool) {
+	switch name {
+	case "setMode":
+		if !slices.ContainsFunc(c.modes, func(m mode) bool { return m.name() == arg }) {
+			return action{}, false
+		}
+		return action{run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+			// the modes may have changed since the action was looked up
+			for i, m := range state.config.modes {
+				if m.name() == arg {
+					setMode(state, cmdChan, i)
+					return
+				}
+			}
+			log.Printf("mode %s is not enabled\n", arg)
+		}}, true
+	case "recordMacro":
+		return action{run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+			toggleMacroRecording(state, arg)
+		}}, arg != ""
+	case "playMacro":
+		return action{run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+			playMacro(state, cmdChan, arg)
+		}}, arg != ""
 	}
+	return action{}, false
 }
 
-func showFancyOutro(cmdChan chan<- comm.Command) {
-	for i := knob; i <= buttonBottomRight; i++ {
-		cmdChan <- comm.NewClearLEDCommand(i)
+// findAction looks up an action by name. Besides the built-in actions,
+// parameterized actions and scripts, every action of an enabled integration can be used as
+// `<integration>.<action>`.
+func (c *appConfig) findAction(name string) (action, bool) {
+	if a, ok := actionRegistry[name]; ok {
+		return a, true
 	}
-	for j := 0; j < 2; j++ {
-		for i := LED5; i <= LED1; i++ {
-			cmdChan <- comm.NewSetLEDCommand(i, '1')
-			time.Sleep(50 * time.Millisecond)
-		}
-		for i := LED1; i >= LED5; i-- {
-			cmdChan <- comm.NewClearLEDCommand(i)
-			time.Sleep(50 * time.Millisecond)
-		}
+	if actionName, arg, ok := strings.Cut(name, ":"); ok {
+		return c.parameterizedAction(actionName, arg)
 	}
-}
-
-func toggleMonitors(cmdChan chan<- comm.Command, state *appState) {
-	if state.monitorsOn {
-		log.Printf("turning monitors off")
-		ddc.SetMonitorsStandby()
-	} else {
-		log.Printf("turning monitors on")
-		ddc.SetMonitorsOn()
+	if s, ok := c.scripts[name]; ok {
+		// scripts get the value of any gesture
+		return action{any: true, run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+			runScript(state, cmdChan, s, value)
+		}}, true
 	}
-	state.monitorsOn = !state.monitorsOn
-	cmdChan <- comm.NewToggleLEDCommand(buttonBottomRight, !state.monitorsOn)
-}
-
-func lockDesktop(state *appState) {
-	log.Println("locking desktop")
-	apis.LockDesktop()
-	if state.config.Numlock {
-		apis.SetNumLock(false)
+	a, ok := integrationAction(c, name)
+	if !ok {
+		return action{}, false
 	}
+	return action{turn: a.Turn, any: a.Any, run: func(state *appState, cmdChan chan<- comm.Command, value int) {
+		runIntegrationAction(state, name, value, "")
+	}}, true
 }
 
-func playStopAnimation(cmdChan chan<- comm.Command) {
-	go func() {
-		for i := 0; i < 5; i++ {
-			cmdChan <- comm.NewSetLEDCommand(knob, 'R')
-			time.Sleep(100 * time.Millisecond)
-		}
-	}()
-	go func() {
-		time.Sleep(50 * time.Millisecond)
-		for i := 0; i < 5; i++ {
-			time.Sleep(100 * time.Millisecond)
-			cmdChan <- comm.NewSetLEDCommand(knob, 'Y')
-		}
-		cmdChan <- comm.NewClearLEDCommand(knob)
-	}()
-}
-
-func foobarNext(state *appState, cmdChan chan<- comm.Command) {
-	log.Println("playing next song")
-	if err := apis.FoobarNext(state.config.Foobar); err != nil {
-		log.Printf("foobar next failed: %v\n", err)
-		return
+func seek(state *appState, cmdChan chan<- comm.Command, value int) {
+	if !state.seeking {
+		log.Println("seeking")
+		state.seekDirection = signum(value)
+		state.seeking = true
 	}
-	cmdChan <- comm.NewSetLEDCommand(knob, 'R')
-	time.AfterFunc(150*time.Millisecond, func() {
-		cmdChan <- comm.NewSetLEDCommand(knob, 'G')
-		time.AfterFunc(150*time.Millisecond, func() {
-			cmdChan <- newCommandForFoobarState(state)
-		})
-	})
-}
-
-func foobarStop(state *appState, cmdChan chan<- comm.Command) {
-	log.Println("stopping playback")
-	if err := apis.FoobarStop(state.config.Foobar); err != nil {
-		log.Printf("foobar stop failed: %v\n", err)
+	if state.seekDirection != signum(value) {
+		log.Println("turn direction not maching initial direction")
+		state.seekDirectionErrors++
+		if state.seekDirectionErrors > 5 {
+			state.animator.play("warning")
+		}
 		return
 	}
-	playStopAnimation(cmdChan)
+	state.mode().seek(state, value)
 }
 
-func foobarTogglePause(state *appState) {
-	log.Println("toggling pause")
-	if err := apis.FoobarTogglePause(state.foobarState, state.config.Foobar); err != nil {
-		log.Printf("foobar pause failed: %v\n", err)
+func showFancyIntro(state *appState, cmdChan chan<- comm.Command) {
+	for _, led := range state.profile.ButtonLEDs() {
+		cmdChan <- state.profile.ClearLED(led)
 	}
+	state.animator.play("intro")
 }
 
-func foobarAdjustVolume(state *appState, cmdChan chan<- comm.Command, delta int) {
-	log.Printf("adjusting volume by %+d\n", delta)
-	volume, isMin, isMax, err := apis.FoobarAdjustVolume(state.foobarState, float64(delta), state.config.Foobar)
-	if err != nil {
-		log.Printf("foobar volume change failed: %v\n", err)
-		return
-	}
-	log.Printf("new volume: %f\n", volume)
-	if isMin {
-		cmdChan <- comm.NewSetLEDCommand(knob, 'R')
-		time.AfterFunc(1*time.Second, func() {
-			cmdChan <- newCommandForFoobarState(state)
-		})
-	} else if isMax {
-		cmdChan <- comm.NewSetLEDCommand(knob, 'G')
-		time.AfterFunc(1*time.Second, func() {
-			cmdChan <- newCommandForFoobarState(state)
-		})
-	}
+func showFancyOutro(state *appState) {
+	// only the outro itself should be visible from now on
+	state.leds.restrict(layerAlert)
+	<-state.animator.play("outro")
+	// give the board time to show the last frame before we exit
+	time.Sleep(100 * time.Millisecond)
 }
 
-func foobarSeek(state *appState, delta int) {
-	log.Printf("seeking %+d", delta)
-	if err := apis.FoobarSeekRelative(delta*5, state.config.Foobar); err != nil {
-		log.Printf("foobar seek failed: %v\n", err)
-		return
-	}
+// renderAllLEDs restores every LED from the current state, e.g. after the board
+// has been reconnected. The notification blinkers refresh their LEDs on every
+// tick so they do not need to be handled here.
+func renderAllLEDs(state *appState, cmdChan chan<- comm.Command) {
+	cmdChan <- state.profile.ToggleLED("topLeft", state.desktopLocked)
+	cmdChan <- state.toggleColorLED("bottomLeft", state.mode().name(), state.modeIndex != 0)
+	cmdChan <- state.profile.ToggleLED("bottomRight", !state.monitorsOn)
+	cmdChan <- state.mode().knobLED(state)
 }
 
-func newCommandForFoobarState(state *appState) comm.Command {
-	if state.foobarState.State == apis.FoobarStatePaused {
-		return comm.NewSetLEDCommand(knob, 'Y')
+func toggleMonitors(cmdChan chan<- comm.Command, state *appState) {
+	if state.monitorsOn {
+		log.Printf("turning monitors off")
+		runIntegrationAction(state, "ddc.standby", 0, "")
 	} else {
-		return comm.NewClearLEDCommand(knob)
+		log.Printf("turning monitors on")
+		runIntegrationAction(state, "ddc.on", 0, "")
 	}
+	state.monitorsOn = !state.monitorsOn
+	cmdChan <- state.profile.ToggleLED("bottomRight", !state.monitorsOn)
 }
 
-func tubeRemoteTogglePause() {
-	log.Println("toggling youtube pause")
-	apis.TubeRemoteTogglePause()
-}
-
-func tubeRemoteStop(cmdChan chan<- comm.Command) {
-	log.Println("stopping youtube")
-	apis.TubeRemoteStop()
-	playStopAnimation(cmdChan)
+// updateMonitorsState keeps track of the monitors when they are switched
+// without toggleMonitors, e.g. by a macro.
+func updateMonitorsState(state *appState, cmdChan chan<- comm.Command, on bool) {
+	state.monitorsOn = on
+	cmdChan <- state.profile.ToggleLED("bottomRight", !state.monitorsOn)
 }
 
-func tubeRemoteAdjustVolume(delta int) {
-	log.Printf("adjusting youtube volume by %+d\n", delta)
-	apis.TubeRemoteAdjustVolume(delta * 2)
+func lockDesktop(state *appState) {
+	log.Println("locking desktop")
+	runIntegrationAction(state, "lock.lock", 0, "")
 }
 
-func tubeRemoteSeek(delta int) {
-	log.Printf("seeking %+d on youtube\n", delta)
-	apis.TubeRemoteSeek(delta * 5)
+func newCommandForFoobarState(state *appState) comm.Command {
+	if state.foobarState.State == apis.FoobarStatePaused {
+		return state.colorLED("knob", "foobar", 'Y')
+	} else {
+		return state.profile.ClearLED("knob")
+	}
 }
 
 func newCommandForTubeRemoteState(state *appState) comm.Command {
 	if state.tubeRemoteState.State == apis.TubeRemoteStatePaused {
-		return comm.NewSetLEDCommand(knob, 'Y')
+		return state.colorLED("knob", "youtube", 'Y')
 	} else {
-		return comm.NewClearLEDCommand(knob)
+		return state.profile.ClearLED("knob")
 	}
 }
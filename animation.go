@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/thiefmaster/controller/comm"
+	"github.com/thiefmaster/controller/hardware"
+)
+
+type keyframe struct {
+	LED string
+	// Color is a color code (R, G, Y, 1 or 0 to turn the LED off), an RGB
+	// color like #ff8800, or `toggle` to invert the underlying state.
+	Color    string
+	Duration time.Duration
+}
+
+type animation struct {
+	Frames []keyframe
+	// Repeat is how often the frames are played; 0 plays them once.
+	Repeat int
+	// Layer is the LED layer the animation is shown on (feedback or alert);
+	// it defaults to the feedback layer.
+	Layer ledLayer
+}
+
+// builtinAnimations returns the animations used by the controller itself. They
+// can be overridden in the `animations` section of the config file.
+func builtinAnimations(profile *hardware.Profile) map[string]animation {
+	bar := profile.Bar()
+	intro := animation{Layer: layerFeedback}
+	for _, led := range bar {
+		intro.Frames = append(intro.Frames, keyframe{LED: led, Color: "0", Duration: 75 * time.Millisecond})
+	}
+	outro := animation{Repeat: 2, Layer: layerAlert}
+	for _, led := range bar {
+		outro.Frames = append(outro.Frames, keyframe{LED: led, Color: "1", Duration: 50 * time.Millisecond})
+	}
+	for i := len(bar) - 1; i >= 0; i-- {
+		outro.Frames = append(outro.Frames, keyframe{LED: bar[i], Color: "0", Duration: 50 * time.Millisecond})
+	}
+	return map[string]animation{
+		"intro": intro,
+		"outro": outro,
+		"stop": {Layer: layerFeedback, Frames: []keyframe{
+			{LED: "knob", Color: "R", Duration: 150 * time.Millisecond},
+			{LED: "knob", Color: "Y", Duration: 50 * time.Millisecond},
+			{LED: "knob", Color: "R", Duration: 50 * time.Millisecond},
+			{LED: "knob", Color: "Y", Duration: 50 * time.Millisecond},
+			{LED: "knob", Color: "R", Duration: 50 * time.Millisecond},
+			{LED: "knob", Color: "Y", Duration: 50 * time.Millisecond},
+			{LED: "knob", Color: "R", Duration: 50 * time.Millisecond},
+			{LED: "knob", Color: "Y", Duration: 150 * time.Millisecond},
+		}},
+		"next": {Layer: layerFeedback, Frames: []keyframe{
+			{LED: "knob", Color: "R", Duration: 150 * time.Millisecond},
+			{LED: "knob", Color: "G", Duration: 150 * time.Millisecond},
+		}},
+		"error": {Layer: layerFeedback, Frames: []keyframe{
+			{LED: "knob", Color: "R", Duration: 1 * time.Second},
+		}},
+		"success": {Layer: layerFeedback, Frames: []keyframe{
+			{LED: "knob", Color: "G", Duration: 1 * time.Second},
+		}},
+		"warning": {Layer: layerFeedback, Frames: []keyframe{
+			{LED: "knob", Color: "R", Duration: 150 * time.Millisecond},
+		}},
+		"audioSwitched": {Layer: layerFeedback, Frames: []keyframe{
+			{LED: "bottomRight", Color: "toggle", Duration: 250 * time.Millisecond},
+		}},
+		"recordMacro": {Repeat: 3, Layer: layerFeedback, Frames: []keyframe{
+			{LED: "knob", Color: "R", Duration: 100 * time.Millisecond},
+			{LED: "knob", Color: "0", Duration: 100 * time.Millisecond},
+		}},
+	}
+}
+
+func (a animation) validate(profile *hardware.Profile) error {
+	if len(a.Frames) == 0 {
+		return fmt.Errorf("no frames")
+	}
+	if a.Repeat < 0 {
+		return fmt.Errorf("invalid repeat count: %d", a.Repeat)
+	}
+	for _, frame := range a.Frames {
+		if _, ok := profile.LED(frame.LED); !ok {
+			return fmt.Errorf("unknown led: %s", frame.LED)
+		}
+		if frame.Duration < 0 {
+			return fmt.Errorf("invalid duration: %v", frame.Duration)
+		}
+		if err := validateFrameColor(frame.Color); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateFrameColor(color string) error {
+	switch color {
+	case "R", "G", "Y", "1", "0", "toggle":
+		return nil
+	}
+	if _, err := comm.ParseRGB(color); err != nil {
+		return fmt.Errorf("invalid color: %s", color)
+	}
+	return nil
+}
+
+// ledCommand creates a command showing a color code or RGB color that passed
+// validateFrameColor on an LED. "toggle" is not supported.
+func ledCommand(profile *hardware.Profile, led, color string) comm.Command {
+	switch {
+	case color == "0":
+		return profile.ClearLED(led)
+	case len(color) == 1:
+		return profile.SetLED(led, color[0])
+	default:
+		rgb, _ := comm.ParseRGB(color)
+		return profile.SetRGB(led, rgb)
+	}
+}
+
+type animationRun struct {
+	name  string
+	owner string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// animator plays animations on top of the compositor. An animation claims its
+// LEDs on its layer while it runs, so once it ends the LEDs automatically show
+// whatever lower layers want to show by then.
+type animator struct {
+	leds       *compositor
+	profile    *hardware.Profile
+	animations map[string]animation
+	runs       map[int]*animationRun
+	counter    int
+	mux        sync.Mutex
+}
+
+func newAnimator(leds *compositor, animations map[string]animation) *animator {
+	return &animator{
+		leds:       leds,
+		profile:    leds.profile,
+		animations: animations,
+		runs:       make(map[int]*animationRun),
+	}
+}
+
+// setAnimations replaces the known animations, e.g. after reloading the config
+// file. Running animations are not affected.
+func (a *animator) setAnimations(animations map[string]animation) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.animations = animations
+}
+
+// play starts an animation and cancels any animation running on the same
+// LEDs. The returned channel is closed once the animation has ended.
+func (a *animator) play(name string) <-chan struct{} {
+	a.mux.Lock()
+	anim, ok := a.animations[name]
+	a.mux.Unlock()
+	if !ok {
+		log.Printf("unknown animation: %s\n", name)
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return a.start(name, anim)
+}
+
+// start plays an animation which does not need to be known by name, e.g. one
+// created on the fly.
+func (a *animator) start(name string, anim animation) <-chan struct{} {
+	a.mux.Lock()
+	a.counter++
+	run := &animationRun{
+		name:  name,
+		owner: fmt.Sprintf("animation %s #%d", name, a.counter),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for _, frame := range anim.Frames {
+		led, _ := a.profile.LED(frame.LED)
+		if owner := a.runs[led.Index]; owner != nil && owner != run {
+			a.cancel(owner)
+		}
+		a.runs[led.Index] = run
+	}
+	a.mux.Unlock()
+
+	go a.run(run, anim)
+	return run.done
+}
+
+func (a *animator) run(run *animationRun, anim animation) {
+	defer close(run.done)
+	defer a.finish(run, anim.Layer)
+	for i := 0; i < max(anim.Repeat, 1); i++ {
+		for _, frame := range anim.Frames {
+			a.showFrame(run, anim.Layer, frame)
+			timer := time.NewTimer(frame.Duration)
+			select {
+			case <-timer.C:
+			case <-run.stop:
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
+
+func (a *animator) showFrame(run *animationRun, layer ledLayer, frame keyframe) {
+	led, _ := a.profile.LED(frame.LED)
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.runs[led.Index] != run {
+		return
+	}
+	var cmd comm.Command
+	if frame.Color == "toggle" {
+		base, ok := a.leds.base(led.Index)
+		cmd = a.profile.ToggleLED(led.Name, !ok || base.Color() == '0')
+	} else {
+		// an explicit "off" must still hide lower layers
+		cmd = ledCommand(a.profile, led.Name, frame.Color)
+	}
+	a.leds.mux.Lock()
+	a.leds.claim(layer, run.owner, cmd)
+	a.leds.mux.Unlock()
+}
+
+// cancel stops an animation. Must be called with the mutex held.
+func (a *animator) cancel(run *animationRun) {
+	close(run.stop)
+	for index, owner := range a.runs {
+		if owner == run {
+			delete(a.runs, index)
+		}
+	}
+}
+
+// finish releases the LEDs claimed by an animation.
+func (a *animator) finish(run *animationRun, layer ledLayer) {
+	a.mux.Lock()
+	for index, owner := range a.runs {
+		if owner == run {
+			delete(a.runs, index)
+		}
+	}
+	a.mux.Unlock()
+	a.leds.mux.Lock()
+	defer a.leds.mux.Unlock()
+	for _, led := range a.profile.LEDs {
+		a.leds.release(layer, run.owner, led.Index)
+	}
+}
@@ -1,7 +1,9 @@
 package apis
 
 import (
+	"context"
 	"errors"
+	"hash/fnv"
 	"log"
 	"syscall"
 	"unsafe"
@@ -10,6 +12,38 @@ import (
 	"github.com/moutend/go-wca/pkg/wca"
 )
 
+func init() {
+	Register("audio", "", func(settings *Settings) (Integration, error) {
+		return &audioTargetIntegration{service: newService("audio")}, nil
+	})
+}
+
+// audioTargetIntegration switches between the audio outputs.
+type audioTargetIntegration struct {
+	service
+}
+
+func (a *audioTargetIntegration) Start(ctx context.Context) <-chan any {
+	return nil
+}
+
+func (a *audioTargetIntegration) Actions() map[string]Action {
+	return map[string]Action{
+		"next": {Run: func(ctx context.Context, value int) error {
+			id, err := SetNextDefaultEndpoint()
+			if err != nil {
+				return err
+			}
+			reportResult(ctx, "select", endpointHash(id))
+			return nil
+		}},
+		// the value identifies the audio output by a hash of its id
+		"select": {Run: func(ctx context.Context, value int) error {
+			return SelectDefaultEndpoint(value)
+		}},
+	}
+}
+
 var (
 	IID_IPolicyConfigVista  = ole.NewGUID("568b9108-44bf-40b4-9006-86afe5b5a620")
 	CLSID_PolicyConfigVista = ole.NewGUID("294935CE-F637-4E7C-A41B-AB255460B862")
@@ -106,42 +140,53 @@ func getDeviceShortName(mmd *wca.IMMDevice) (name string, err error) {
 	return pv.String(), nil
 }
 
-func SetNextDefaultEndpoint() (err error) {
-	err = ole.CoInitializeEx(0, ole.COINIT_APARTMENTTHREADED)
-	if err != nil {
+// endpointHash identifies an audio output by a number which stays the same as
+// long as its id does.
+func endpointHash(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32())
+}
+
+// withDeviceEnumerator calls f with an enumerator of the audio devices.
+func withDeviceEnumerator(f func(mmde *wca.IMMDeviceEnumerator) error) error {
+	if err := ole.CoInitializeEx(0, ole.COINIT_APARTMENTTHREADED); err != nil {
 		return err
 	}
 	defer ole.CoUninitialize()
 
 	var mmde *wca.IMMDeviceEnumerator
-	if err = wca.CoCreateInstance(wca.CLSID_MMDeviceEnumerator, 0, wca.CLSCTX_ALL, wca.IID_IMMDeviceEnumerator, &mmde); err != nil {
+	if err := wca.CoCreateInstance(wca.CLSID_MMDeviceEnumerator, 0, wca.CLSCTX_ALL, wca.IID_IMMDeviceEnumerator, &mmde); err != nil {
 		return err
 	}
 	defer mmde.Release()
+	return f(mmde)
+}
 
+// audioEndpoints returns the ids of the active audio outputs, their names and
+// the id of the default one.
+func audioEndpoints(mmde *wca.IMMDeviceEnumerator) (ids []string, names map[string]string, defaultID string, err error) {
 	var mmd *wca.IMMDevice
 	if err = mmde.GetDefaultAudioEndpoint(wca.ERender, wca.EConsole, &mmd); err != nil {
-		return err
+		return
 	}
 	defer mmd.Release()
 
-	var defaultDevID string
-	if err = mmdGetID(mmd, &defaultDevID); err != nil {
-		return err
+	if err = mmdGetID(mmd, &defaultID); err != nil {
+		return
 	}
 
 	var dco *wca.IMMDeviceCollection
 	if err = mmde.EnumAudioEndpoints(wca.ERender, wca.DEVICE_STATE_ACTIVE, &dco); err != nil {
-		return err
+		return
 	}
 
 	var count uint32
 	if err = dco.GetCount(&count); err != nil {
-		return err
+		return
 	}
 
-	var ids []string
-	devMap := make(map[string]string)
+	names = make(map[string]string)
 	for i := uint32(0); i < count; i++ {
 		var mmd *wca.IMMDevice
 		if err = dco.Item(i, &mmd); err != nil {
@@ -155,34 +200,61 @@ func SetNextDefaultEndpoint() (err error) {
 
 		var name string
 		if name, err = getDeviceShortName(mmd); err != nil {
-			return err
-		}
-		devMap[id] = name
-	}
-
-	var next string
-	for i, id := range ids {
-		if id == defaultDevID {
-			next = ids[(i+1)%len(ids)]
-			break
+			return
 		}
+		names[id] = name
 	}
+	return ids, names, defaultID, nil
+}
 
-	if next == "" || next == defaultDevID {
-		return errors.New("No alternative device found")
-	}
-
-	log.Printf("Switching default audio output to: %s\n", devMap[next])
-
+func setDefaultEndpoint(id string) error {
 	var pcv *IPolicyConfigVista
-	if err = wca.CoCreateInstance(CLSID_PolicyConfigVista, 0, wca.CLSCTX_ALL, IID_IPolicyConfigVista, &pcv); err != nil {
+	if err := wca.CoCreateInstance(CLSID_PolicyConfigVista, 0, wca.CLSCTX_ALL, IID_IPolicyConfigVista, &pcv); err != nil {
 		return err
 	}
 	defer pcv.Release()
 
-	if err = pcv.SetDefaultEndpoint(next, wca.EConsole); err != nil {
-		return err
-	}
+	return pcv.SetDefaultEndpoint(id, wca.EConsole)
+}
 
-	return nil
+// SetNextDefaultEndpoint switches to the next audio output and returns its id.
+func SetNextDefaultEndpoint() (next string, err error) {
+	err = withDeviceEnumerator(func(mmde *wca.IMMDeviceEnumerator) error {
+		ids, names, defaultID, err := audioEndpoints(mmde)
+		if err != nil {
+			return err
+		}
+
+		for i, id := range ids {
+			if id == defaultID {
+				next = ids[(i+1)%len(ids)]
+				break
+			}
+		}
+
+		if next == "" || next == defaultID {
+			return errors.New("No alternative device found")
+		}
+
+		log.Printf("Switching default audio output to: %s\n", names[next])
+		return setDefaultEndpoint(next)
+	})
+	return next, err
+}
+
+// SelectDefaultEndpoint switches to the audio output identified by hash.
+func SelectDefaultEndpoint(hash int) error {
+	return withDeviceEnumerator(func(mmde *wca.IMMDeviceEnumerator) error {
+		ids, names, _, err := audioEndpoints(mmde)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if endpointHash(id) == hash {
+				log.Printf("Switching default audio output to: %s\n", names[id])
+				return setDefaultEndpoint(id)
+			}
+		}
+		return errors.New("audio output not found")
+	})
 }
@@ -0,0 +1,29 @@
+package apis
+
+import (
+	"context"
+	"time"
+)
+
+// send sends value unless ctx is cancelled first and tells whether it was sent.
+func send[T any](ctx context.Context, ch chan<- T, value T) bool {
+	select {
+	case ch <- value:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleep waits for d unless ctx is cancelled first and tells whether it waited
+// for the full duration.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
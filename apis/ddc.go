@@ -0,0 +1,40 @@
+package apis
+
+import (
+	"context"
+
+	"github.com/thiefmaster/controller/ddc"
+)
+
+func init() {
+	Register("ddc", "", func(settings *Settings) (Integration, error) {
+		return &ddcIntegration{service: newService("ddc")}, nil
+	})
+}
+
+// ddcIntegration switches the monitors on and to standby. Its state tells
+// whether they have last been switched on.
+type ddcIntegration struct {
+	service
+	onChan chan bool
+}
+
+func (d *ddcIntegration) Start(ctx context.Context) <-chan any {
+	d.onChan = make(chan bool)
+	return relay(ctx, &d.service, d.onChan)
+}
+
+func (d *ddcIntegration) Actions() map[string]Action {
+	return map[string]Action{
+		"on": {Run: func(ctx context.Context, value int) error {
+			ddc.SetMonitorsOn()
+			send(ctx, d.onChan, true)
+			return nil
+		}},
+		"standby": {Run: func(ctx context.Context, value int) error {
+			ddc.SetMonitorsStandby()
+			send(ctx, d.onChan, false)
+			return nil
+		}},
+	}
+}
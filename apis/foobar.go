@@ -2,6 +2,7 @@ package apis
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -73,19 +74,106 @@ func foobarRequest(method, path string, payload interface{}, credentials HTTPCre
 	return body, nil
 }
 
-func subscribeFoobarState(eventChan chan<- FoobarPlayerInfo, credentials HTTPCredentials) {
+func init() {
+	Register("foobar", "foobar", newFoobarIntegration)
+}
+
+// foobarIntegration controls foobar2000 through its beefweb http api. Its
+// state is a FoobarPlayerInfo.
+type foobarIntegration struct {
+	service
+	credentials HTTPCredentials
+}
+
+func newFoobarIntegration(settings *Settings) (Integration, error) {
+	var credentials HTTPCredentials
+	if settings != nil {
+		if err := settings.Decode(&credentials); err != nil {
+			return nil, err
+		}
+	}
+	if credentials.BaseURL == "" {
+		return nil, errors.New("no url specified")
+	}
+	return &foobarIntegration{service: newService("foobar"), credentials: credentials}, nil
+}
+
+func (f *foobarIntegration) Start(ctx context.Context) <-chan any {
+	eventChan := make(chan FoobarPlayerInfo)
+	f.start(func() {
+		subscribeFoobarState(ctx, &f.service, eventChan, f.credentials)
+	})
+	return relay(ctx, &f.service, eventChan)
+}
+
+func (f *foobarIntegration) player() FoobarPlayerInfo {
+	info, _ := f.State().(FoobarPlayerInfo)
+	return info
+}
+
+func (f *foobarIntegration) Actions() map[string]Action {
+	return map[string]Action{
+		"next": {Run: func(ctx context.Context, value int) error {
+			return FoobarNext(f.credentials)
+		}},
+		"stop": {Run: func(ctx context.Context, value int) error {
+			return FoobarStop(f.credentials)
+		}},
+		"togglePause": {Run: func(ctx context.Context, value int) error {
+			player := f.player()
+			if err := FoobarTogglePause(player, f.credentials); err != nil {
+				return err
+			}
+			if player.State == FoobarStatePlaying {
+				reportResult(ctx, "pause", 0)
+			} else {
+				reportResult(ctx, "play", 0)
+			}
+			return nil
+		}},
+		"play": {Run: func(ctx context.Context, value int) error {
+			return FoobarPlay(f.credentials)
+		}},
+		"pause": {Run: func(ctx context.Context, value int) error {
+			return FoobarPause(f.credentials)
+		}},
+		"volume": {Turn: true, Run: func(ctx context.Context, value int) error {
+			volume, isMin, isMax, err := FoobarAdjustVolume(f.player(), float64(value), f.credentials)
+			if err != nil {
+				return err
+			}
+			if isMin || isMax {
+				reportLimit(ctx, isMax)
+			}
+			reportResult(ctx, "setVolume", int(math.Round(volume*10)))
+			return nil
+		}},
+		// the value is the volume in tenths of a dB
+		"setVolume": {Run: func(ctx context.Context, value int) error {
+			return FoobarSetVolume(float64(value)/10, f.credentials)
+		}},
+		"seek": {Turn: true, Run: func(ctx context.Context, value int) error {
+			return FoobarSeekRelative(value*5, f.credentials)
+		}},
+	}
+}
+
+func subscribeFoobarState(ctx context.Context, s *service, eventChan chan<- FoobarPlayerInfo, credentials HTTPCredentials) {
 	req, err := newRequest("GET", "/api/query/updates?player=true", nil, credentials)
 	if err != nil {
 		log.Fatalf("newRequest failed: %v", err)
 	}
 
-	stream, err := eventsource.SubscribeWithRequest("", req)
+	stream, err := eventsource.SubscribeWithRequest("", req.WithContext(ctx))
 	if err != nil {
 		log.Printf("subscribe failed: %v\n", err)
-		time.Sleep(1 * time.Second)
-		defer subscribeFoobarState(eventChan, credentials)
+		s.setHealth(err)
+		if sleep(ctx, 1*time.Second) {
+			defer subscribeFoobarState(ctx, s, eventChan, credentials)
+		}
 		return
 	}
+	defer stream.Close()
 
 	stream.InitialRetryDelay = 500 * time.Millisecond
 	stream.MaxRetryDelay = 5 * time.Second
@@ -94,9 +182,14 @@ func subscribeFoobarState(eventChan chan<- FoobarPlayerInfo, credentials HTTPCre
 	if err != nil {
 		log.Printf("could not get initial foobar state: %v\n", err)
 	}
-	eventChan <- lastState
+	s.setHealth(err)
+	if !send(ctx, eventChan, lastState) {
+		return
+	}
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case event := <-stream.Events:
 			data := event.Data()
 			if data == "" || data == "{}" {
@@ -106,26 +199,26 @@ func subscribeFoobarState(eventChan chan<- FoobarPlayerInfo, credentials HTTPCre
 			if err := json.Unmarshal([]byte(data), &status); err != nil {
 				log.Printf("could not unmarshal foobar event: %v\n", err)
 			} else if status.Player != lastState {
-				eventChan <- status.Player
+				s.setHealth(nil)
+				if !send(ctx, eventChan, status.Player) {
+					return
+				}
 				lastState = status.Player
 			}
 		case err := <-stream.Errors:
 			log.Printf("foobar event stream error: %v\n", err)
+			s.setHealth(err)
 			newState := FoobarPlayerInfo{State: FoobarStateOffline, Volume: lastState.Volume}
 			if newState != lastState {
-				eventChan <- newState
+				if !send(ctx, eventChan, newState) {
+					return
+				}
 				lastState = newState
 			}
 		}
 	}
 }
 
-func SubscribeFoobarState(credentials HTTPCredentials) <-chan FoobarPlayerInfo {
-	eventChan := make(chan FoobarPlayerInfo)
-	go subscribeFoobarState(eventChan, credentials)
-	return eventChan
-}
-
 func getFoobarState(credentials HTTPCredentials) (FoobarPlayerInfo, error) {
 	var status foobarPlayerJSON
 	body, err := foobarRequest("GET", "/api/player", nil, credentials)
@@ -152,6 +245,20 @@ func FoobarStop(credentials HTTPCredentials) error {
 	return nil
 }
 
+func FoobarPlay(credentials HTTPCredentials) error {
+	if _, err := foobarRequest("POST", "/api/player/play", nil, credentials); err != nil {
+		return err
+	}
+	return nil
+}
+
+func FoobarPause(credentials HTTPCredentials) error {
+	if _, err := foobarRequest("POST", "/api/player/pause", nil, credentials); err != nil {
+		return err
+	}
+	return nil
+}
+
 func FoobarTogglePause(state FoobarPlayerInfo, credentials HTTPCredentials) error {
 	if state.State == FoobarStateStopped {
 		if _, err := foobarRequest("POST", "/api/player/play", nil, credentials); err != nil {
@@ -187,6 +294,18 @@ func FoobarAdjustVolume(state FoobarPlayerInfo, delta float64, credentials HTTPC
 	return payload.Volume, payload.Volume == state.Volume.Min, payload.Volume == state.Volume.Max, nil
 }
 
+func FoobarSetVolume(volume float64, credentials HTTPCredentials) error {
+	payload := struct {
+		Volume float64 `json:"volume"`
+	}{
+		Volume: volume,
+	}
+	if _, err := foobarRequest("POST", "/api/player", payload, credentials); err != nil {
+		return err
+	}
+	return nil
+}
+
 func FoobarSeekRelative(delta int, credentials HTTPCredentials) error {
 	payload := struct {
 		RelativePosition int `json:"relativePosition"`
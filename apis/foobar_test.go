@@ -0,0 +1,76 @@
+package apis
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFoobarVolumeLimits(t *testing.T) {
+	var volume float64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Volume float64 `json:"volume"`
+		}
+		if r.Method != "POST" || r.URL.Path != "/api/player" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		volume = payload.Volume
+	}))
+	defer server.Close()
+
+	integration, err := newFoobarIntegration(&Settings{raw: map[string]any{"url": server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := integration.(*foobarIntegration)
+	action := f.Actions()["volume"]
+
+	tests := []struct {
+		name    string
+		current float64
+		delta   int
+		volume  float64
+		// the limit reported, if any
+		limit string
+	}{
+		{name: "turning down", current: -5, delta: -2, volume: -6},
+		{name: "turning up", current: -5, delta: 2, volume: -4},
+		{name: "reaching the minimum", current: -99, delta: -2, volume: -100, limit: "lower"},
+		{name: "turning down at the minimum", current: -100, delta: -1, volume: -100, limit: "lower"},
+		{name: "reaching the maximum", current: -1, delta: 4, volume: 0, limit: "upper"},
+		{name: "turning up at the maximum", current: 0, delta: 1, volume: 0, limit: "upper"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var player FoobarPlayerInfo
+			player.State = FoobarStatePlaying
+			player.Volume.Min = -100
+			player.Volume.Max = 0
+			player.Volume.Current = tt.current
+			f.setState(player)
+
+			limit := ""
+			ctx := WithLimit(context.Background(), func(upper bool) {
+				if upper {
+					limit = "upper"
+				} else {
+					limit = "lower"
+				}
+			})
+			if err := action.Run(ctx, tt.delta); err != nil {
+				t.Fatal(err)
+			}
+			if volume != tt.volume || limit != tt.limit {
+				t.Errorf("got volume %v and limit %q, want %v and %q", volume, limit, tt.volume, tt.limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package apis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Integration is a service the controller talks to. Integrations register
+// themselves in the registry and are configured by their section in the
+// config file.
+type Integration interface {
+	Name() string
+	// Start runs the integration until ctx is cancelled and sends its state
+	// whenever it changes. It must not block.
+	Start(ctx context.Context) <-chan any
+	// Wait blocks until the integration has stopped after the context passed
+	// to Start was cancelled. It returns ctx.Err() if ctx is done before.
+	Wait(ctx context.Context) error
+	// State returns the latest state sent by the integration.
+	State() any
+	Health() Health
+	// Actions returns what the integration can do by name.
+	Actions() map[string]Action
+}
+
+// Action is something an integration can do. value is the number of steps a
+// knob was turned for turn actions.
+type Action struct {
+	Turn bool
+	// Any actions can be bound to all gestures, e.g. because the integration
+	// only knows whether they are turn actions once it runs
+	Any bool
+	Run func(ctx context.Context, value int) error
+}
+
+type resultKey struct{}
+
+// WithResult returns a context through which actions report an action of the
+// same integration and its value which reproduce their outcome regardless of
+// the state at the time, e.g. setting the volume to the new value instead of
+// changing it. Macros record these instead of the actions that ran.
+func WithResult(ctx context.Context, report func(action string, value int)) context.Context {
+	return context.WithValue(ctx, resultKey{}, report)
+}
+
+func reportResult(ctx context.Context, action string, value int) {
+	if report, ok := ctx.Value(resultKey{}).(func(string, int)); ok {
+		report(action, value)
+	}
+}
+
+type limitKey struct{}
+
+// WithLimit returns a context through which turn actions report that they hit
+// the lower or upper end of their range, e.g. the minimum or maximum volume, so
+// the controller can show that turning further does nothing.
+func WithLimit(ctx context.Context, report func(upper bool)) context.Context {
+	return context.WithValue(ctx, limitKey{}, report)
+}
+
+func reportLimit(ctx context.Context, upper bool) {
+	if report, ok := ctx.Value(limitKey{}).(func(bool)); ok {
+		report(upper)
+	}
+}
+
+// Health tells whether an integration works.
+type Health struct {
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+	Since time.Time `json:"since"`
+}
+
+// Factory creates an integration from its settings. settings is nil if the
+// config file has no section for it; a nil integration means it is disabled.
+type Factory func(settings *Settings) (Integration, error)
+
+type registration struct {
+	name string
+	// the key of the settings in the config file
+	key string
+	new Factory
+}
+
+var registry []registration
+
+// Register adds an integration whose settings are found under key in the
+// config file. Integrations without settings use an empty key.
+func Register(name, key string, factory Factory) {
+	registry = append(registry, registration{name: name, key: key, new: factory})
+}
+
+// Registered tells whether there is an integration with a name.
+func Registered(name string) bool {
+	for _, r := range registry {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigKeys returns the keys of all integrations that have settings in the
+// config file.
+func ConfigKeys() []string {
+	var keys []string
+	for _, r := range registry {
+		if r.key != "" {
+			keys = append(keys, r.key)
+		}
+	}
+	return keys
+}
+
+// ConfigKey returns the key of an integration in the config file.
+func ConfigKey(name string) string {
+	for _, r := range registry {
+		if r.name == name {
+			return r.key
+		}
+	}
+	return ""
+}
+
+// Configure creates all enabled integrations from the sections of the config
+// file, which are looked up by key.
+func Configure(sections map[string]any) ([]Integration, error) {
+	var integrations []Integration
+	for _, r := range registry {
+		var settings *Settings
+		if raw, ok := sections[r.key]; ok && r.key != "" {
+			settings = &Settings{raw: raw}
+		}
+		integration, err := r.new(settings)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", r.key, err)
+		}
+		if integration != nil {
+			integrations = append(integrations, integration)
+		}
+	}
+	return integrations, nil
+}
+
+// Settings is the section of an integration in the config file.
+type Settings struct {
+	raw any
+}
+
+// Decode decodes the settings into out, which has to be a pointer.
+func (s *Settings) Decode(out any) error {
+	data, err := yaml.Marshal(s.raw)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, out)
+}
+
+// service implements the state and health bookkeeping of an integration.
+type service struct {
+	name   string
+	state  any
+	health Health
+	mux    sync.Mutex
+	// the goroutines started by the integration
+	running sync.WaitGroup
+}
+
+func newService(name string) service {
+	return service{name: name, health: Health{OK: true, Since: time.Now()}}
+}
+
+func (s *service) Name() string {
+	return s.name
+}
+
+func (s *service) State() any {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.state
+}
+
+func (s *service) Health() Health {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.health
+}
+
+// start runs f in a goroutine Wait waits for.
+func (s *service) start(f func()) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		f()
+	}()
+}
+
+func (s *service) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Actions returns no actions for integrations that only track something.
+func (s *service) Actions() map[string]Action {
+	return nil
+}
+
+func (s *service) setState(state any) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.state = state
+}
+
+// setHealth records whether the integration works; err is nil if it does.
+func (s *service) setHealth(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ok := err == nil
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	if s.health.OK != ok || s.health.Error != message {
+		s.health = Health{OK: ok, Error: message, Since: time.Now()}
+	}
+}
+
+// relay records every state sent on ch and passes it on to the returned
+// channel until ctx is cancelled.
+func relay[T any](ctx context.Context, s *service, ch <-chan T) <-chan any {
+	out := make(chan any)
+	s.start(func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case state := <-ch:
+				s.setState(state)
+				if !send(ctx, out, any(state)) {
+					return
+				}
+			}
+		}
+	})
+	return out
+}
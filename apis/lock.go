@@ -1,9 +1,75 @@
 package apis
 
 import (
+	"context"
 	"log"
+	"sync"
+
+	"github.com/thiefmaster/controller/wts"
+)
+
+var (
+	// the session monitor can only be started once
+	monitorOnce sync.Once
+	lockedChan  <-chan bool
 )
 
+func init() {
+	Register("lock", "numlock", newLockIntegration)
+}
+
+// lockIntegration tracks whether the desktop is locked and locks it. If
+// numlock is enabled it turns numlock off while the desktop is locked. Its
+// state is whether the desktop is locked.
+type lockIntegration struct {
+	service
+	numlock bool
+}
+
+func newLockIntegration(settings *Settings) (Integration, error) {
+	l := &lockIntegration{service: newService("lock")}
+	if settings != nil {
+		if err := settings.Decode(&l.numlock); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *lockIntegration) Start(ctx context.Context) <-chan any {
+	monitorOnce.Do(func() {
+		lockedChan = wts.RunMonitor()
+	})
+	eventChan := make(chan bool)
+	l.start(func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case locked := <-lockedChan:
+				if !locked && l.numlock {
+					SetNumLock(true)
+				}
+				if !send(ctx, eventChan, locked) {
+					return
+				}
+			}
+		}
+	})
+	return relay(ctx, &l.service, eventChan)
+}
+
+func (l *lockIntegration) Actions() map[string]Action {
+	return map[string]Action{
+		"lock": {Run: func(ctx context.Context, value int) error {
+			LockDesktop()
+			if l.numlock {
+				SetNumLock(false)
+			}
+			return nil
+		}},
+	}
+}
 
 func LockDesktop() {
 	if ret, _, err := lockWorkStationProc.Call(); ret == 0 {
@@ -3,6 +3,7 @@ package apis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"strings"
 	"time"
@@ -20,36 +21,109 @@ type MattermostSettings struct {
 type MattermostState struct {
 	HasMessages bool
 	HasMentions bool
+	// how many posts, and posts mentioning the user, arrived since the
+	// integration connected. They change with every post, so the controller
+	// sees each one even if there were unread posts already.
+	Posts    int
+	Mentions int
 }
 
-func SubscribeMattermostState(settings MattermostSettings) <-chan MattermostState {
+func init() {
+	Register("mattermost", "mattermost", newMattermostIntegration)
+}
+
+// mattermostIntegration tracks unread messages and mentions in a channel and
+// in direct messages. Its state is a MattermostState.
+type mattermostIntegration struct {
+	service
+	settings MattermostSettings
+}
+
+func newMattermostIntegration(settings *Settings) (Integration, error) {
+	var mattermost MattermostSettings
+	if settings != nil {
+		if err := settings.Decode(&mattermost); err != nil {
+			return nil, err
+		}
+	}
+	if mattermost.ServerURL == "" {
+		return nil, nil
+	}
+	if mattermost.AccessToken == "" {
+		return nil, errors.New("no token specified")
+	}
+	if mattermost.TeamName == "" {
+		return nil, errors.New("no team specified")
+	}
+	if mattermost.ChannelName == "" {
+		return nil, errors.New("no channel specified")
+	}
+	return &mattermostIntegration{service: newService("mattermost"), settings: mattermost}, nil
+}
+
+func (m *mattermostIntegration) Start(ctx context.Context) <-chan any {
 	eventChan := make(chan MattermostState)
-	go subscribeMattermostState(eventChan, settings)
-	return eventChan
+	m.start(func() {
+		subscribeMattermostState(ctx, &m.service, eventChan, m.settings)
+	})
+	return relay(ctx, &m.service, eventChan)
 }
 
-func retry(eventChan chan<- MattermostState, settings MattermostSettings) {
-	time.Sleep(1 * time.Second)
-	subscribeMattermostState(eventChan, settings)
+func (m *mattermostIntegration) Actions() map[string]Action {
+	return map[string]Action{
+		// value is how many minutes do not disturb lasts; 0 means until the
+		// status is changed again
+		"dnd": {Run: func(ctx context.Context, value int) error {
+			status := &mm.Status{Status: mm.StatusDnd, Manual: true}
+			if value > 0 {
+				status.DNDEndTime = time.Now().Add(time.Duration(value) * time.Minute).Unix()
+			}
+			return m.setStatus(ctx, status)
+		}},
+		"online": {Run: func(ctx context.Context, value int) error {
+			return m.setStatus(ctx, &mm.Status{Status: mm.StatusOnline, Manual: true})
+		}},
+	}
 }
 
-func subscribeMattermostState(eventChan chan<- MattermostState, settings MattermostSettings) {
-	defer retry(eventChan, settings)
+// setStatus sets the status of the user the token belongs to.
+func (m *mattermostIntegration) setStatus(ctx context.Context, status *mm.Status) error {
+	client := mm.NewAPIv4Client(m.settings.ServerURL)
+	client.SetToken(m.settings.AccessToken)
+	me, _, err := client.GetMe(ctx, "")
+	if err != nil {
+		return err
+	}
+	status.UserId = me.Id
+	_, _, err = client.UpdateUserStatus(ctx, me.Id, status)
+	return err
+}
+
+func retry(ctx context.Context, s *service, eventChan chan<- MattermostState, settings MattermostSettings) {
+	if sleep(ctx, 1*time.Second) {
+		subscribeMattermostState(ctx, s, eventChan, settings)
+	}
+}
+
+func subscribeMattermostState(ctx context.Context, s *service, eventChan chan<- MattermostState, settings MattermostSettings) {
+	defer retry(ctx, s, eventChan, settings)
 
 	client := mm.NewAPIv4Client(settings.ServerURL)
 	client.SetToken(settings.AccessToken)
 
 	var userId, channelId string
 
-	if me, _, err := client.GetMe(context.Background(), ""); err != nil {
+	if me, _, err := client.GetMe(ctx, ""); err != nil {
 		log.Printf("could not get user info from mattermost: %v\n", err)
+		s.setHealth(err)
 		return
 	} else {
 		userId = me.Id
 	}
 
-	if channel, _, err := client.GetChannelByNameForTeamName(context.Background(), settings.ChannelName, settings.TeamName, ""); err != nil {
+	if channel, _, err := client.GetChannelByNameForTeamName(ctx, settings.ChannelName, settings.TeamName, ""); err != nil {
 		log.Printf("could not get channel from mattermost: %v\n", err)
+		s.setHealth(err)
 		return
 	} else {
 		channelId = channel.Id
@@ -57,30 +131,36 @@ func subscribeMattermostState(eventChan chan<- MattermostState, settings Matterm
 
 	messageChannels := make(map[string]bool)
 	mentionChannels := make(map[string]bool)
-	getCurrentUnreads(settings, client, channelId, messageChannels, mentionChannels)
+	getCurrentUnreads(ctx, settings, client, channelId, messageChannels, mentionChannels)
 	state := MattermostState{
 		HasMessages: len(messageChannels) > 0,
 		HasMentions: len(mentionChannels) > 0,
 	}
-	eventChan <- state
+	if !send(ctx, eventChan, state) {
+		return
+	}
 
 	// connect to websocket for live updates
 	ws, err := mm.NewWebSocketClient(strings.Replace(settings.ServerURL, "http", "ws", 1), client.AuthToken)
 	if err != nil {
 		log.Printf("could not connect to websocket: %v\n", err)
+		s.setHealth(err)
 		return
 	}
+	s.setHealth(nil)
 	ws.Listen()
+	defer ws.Close()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ws.PingTimeoutChannel:
 			log.Println("mattermost websocket: ping timeout")
-			ws.Close()
+			s.setHealth(errors.New("websocket ping timeout"))
 			return
 		case resp := <-ws.EventChannel:
 			if resp == nil {
 				log.Println("mattermost websocket: event channel closed")
-				ws.Close()
 				return
 			}
 			if resp.EventType() == mm.WebsocketEventChannelViewed {
@@ -91,9 +171,13 @@ func subscribeMattermostState(eventChan chan<- MattermostState, settings Matterm
 				newState := MattermostState{
 					HasMessages: len(messageChannels) > 0,
 					HasMentions: len(mentionChannels) > 0,
+					Posts:       state.Posts,
+					Mentions:    state.Mentions,
 				}
 				if newState != state {
-					eventChan <- newState
+					if !send(ctx, eventChan, newState) {
+						return
+					}
 					state = newState
 				}
 			} else if resp.EventType() == mm.WebsocketEventMultipleChannelsViewed {
@@ -103,9 +187,13 @@ func subscribeMattermostState(eventChan chan<- MattermostState, settings Matterm
 					newState := MattermostState{
 						HasMessages: len(messageChannels) > 0,
 						HasMentions: len(mentionChannels) > 0,
+						Posts:       state.Posts,
+						Mentions:    state.Mentions,
 					}
 					if newState != state {
-						eventChan <- newState
+						if !send(ctx, eventChan, newState) {
+							return
+						}
 						state = newState
 					}
 				}
@@ -120,23 +208,23 @@ func subscribeMattermostState(eventChan chan<- MattermostState, settings Matterm
 				isDirect := channelType == mm.ChannelTypeDirect || channelType == mm.ChannelTypeGroup
 				if post.UserId != userId && (post.ChannelId == channelId || isDirect) {
 					messageChannels[post.ChannelId] = true
+					newState := MattermostState{Posts: state.Posts + 1, Mentions: state.Mentions}
 					if resp.GetData()["mentions"] != nil {
 						mentions := mm.ArrayFromJSON(strings.NewReader(resp.GetData()["mentions"].(string)))
 						for _, v := range mentions {
 							if v == userId {
 								mentionChannels[post.ChannelId] = true
+								newState.Mentions++
 								break
 							}
 						}
 					}
-					newState := MattermostState{
-						HasMessages: len(messageChannels) > 0,
-						HasMentions: len(mentionChannels) > 0,
-					}
-					if newState != state {
-						eventChan <- newState
-						state = newState
+					newState.HasMessages = len(messageChannels) > 0
+					newState.HasMentions = len(mentionChannels) > 0
+					if !send(ctx, eventChan, newState) {
+						return
 					}
+					state = newState
 				}
 			}
 		}
@@ -144,13 +232,14 @@ func subscribeMattermostState(eventChan chan<- MattermostState, settings Matterm
 }
 
 func getCurrentUnreads(
+	ctx context.Context,
 	settings MattermostSettings, client *mm.Client4,
 	channelId string,
 	messageChannels, mentionChannels map[string]bool,
 ) {
 	// get team id
 	var teamId string
-	if team, _, err := client.GetTeamByName(context.Background(), settings.TeamName, ""); err != nil {
+	if team, _, err := client.GetTeamByName(ctx, settings.TeamName, ""); err != nil {
 		log.Printf("could not get team from mattermost: %v\n", err)
 		return
 	} else {
@@ -159,7 +248,7 @@ func getCurrentUnreads(
 
 	// get channel details
 	channelsById := make(map[string]*mm.Channel)
-	if channels, _, err := client.GetChannelsForTeamForUser(context.Background(), teamId, "me", false, ""); err != nil {
+	if channels, _, err := client.GetChannelsForTeamForUser(ctx, teamId, "me", false, ""); err != nil {
 		log.Printf("could not get channels from mattermost: %v\n", err)
 		return
 	} else {
@@ -169,7 +258,7 @@ func getCurrentUnreads(
 	}
 
 	// get own channel membership, which includes the unread counts
-	if members, _, err := client.GetChannelMembersForUser(context.Background(), "me", teamId, ""); err != nil {
+	if members, _, err := client.GetChannelMembersForUser(ctx, "me", teamId, ""); err != nil {
 		log.Printf("could not get unreads from mattermost: %v\n", err)
 	} else {
 		for _, member := range members {
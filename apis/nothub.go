@@ -1,6 +1,7 @@
 package apis
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"os"
@@ -16,50 +17,87 @@ type NotHubState struct {
 	PrivMsg bool
 }
 
-func subscribeNotHubState(eventChan chan<- NotHubState, credentials HTTPCredentials) {
+func init() {
+	Register("nothub", "nothub", newNotHubIntegration)
+}
+
+// notHubIntegration tracks IRC notifications relayed by nothub. Its state is a
+// NotHubState.
+type notHubIntegration struct {
+	service
+	credentials HTTPCredentials
+}
+
+func newNotHubIntegration(settings *Settings) (Integration, error) {
+	var credentials HTTPCredentials
+	if settings != nil {
+		if err := settings.Decode(&credentials); err != nil {
+			return nil, err
+		}
+	}
+	if credentials.BaseURL == "" {
+		return nil, nil
+	}
+	return &notHubIntegration{service: newService("nothub"), credentials: credentials}, nil
+}
+
+func (n *notHubIntegration) Start(ctx context.Context) <-chan any {
+	eventChan := make(chan NotHubState)
+	n.start(func() {
+		subscribeNotHubState(ctx, &n.service, eventChan, n.credentials)
+	})
+	return relay(ctx, &n.service, eventChan)
+}
+
+func subscribeNotHubState(ctx context.Context, s *service, eventChan chan<- NotHubState, credentials HTTPCredentials) {
 	req, err := newRequest("GET", "/updates", nil, credentials)
 	if err != nil {
 		log.Fatalf("newRequest failed: %v", err)
 	}
 
-	stream, err := eventsource.SubscribeWithRequest("", req)
+	stream, err := eventsource.SubscribeWithRequest("", req.WithContext(ctx))
 	if err != nil {
 		log.Printf("subscribe failed: %v\n", err)
-		time.Sleep(1 * time.Second)
-		defer subscribeNotHubState(eventChan, credentials)
+		s.setHealth(err)
+		if sleep(ctx, 1*time.Second) {
+			defer subscribeNotHubState(ctx, s, eventChan, credentials)
+		}
 		return
 	}
+	defer stream.Close()
 
 	stream.InitialRetryDelay = 500 * time.Millisecond
 	stream.MaxRetryDelay = 5 * time.Second
 	stream.Logger = log.New(os.Stderr, "", log.LstdFlags)
 	var lastState NotHubState
-	initialStateSent := false
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case event := <-stream.Events:
 			data := event.Data()
+			s.setHealth(nil)
 			var newState NotHubState
 			if err := json.Unmarshal([]byte(data), &newState); err != nil {
 				log.Printf("could not unmarshal nothub event: %v\n", err)
-			} else if newState != lastState || !initialStateSent {
-				eventChan <- newState
+			} else {
+				// sent even if nothing changed so the controller sees
+				// every notification, e.g. to count them during DND
+				if !send(ctx, eventChan, newState) {
+					return
+				}
 				lastState = newState
-				initialStateSent = true
 			}
 		case err := <-stream.Errors:
 			log.Printf("nothub event stream error: %v\n", err)
+			s.setHealth(err)
 			newState := NotHubState{}
 			if newState != lastState {
-				eventChan <- newState
+				if !send(ctx, eventChan, newState) {
+					return
+				}
 				lastState = newState
 			}
 		}
 	}
 }
-
-func SubscribeNotHubState(credentials HTTPCredentials) <-chan NotHubState {
-	eventChan := make(chan NotHubState)
-	go subscribeNotHubState(eventChan, credentials)
-	return eventChan
-}
@@ -0,0 +1,476 @@
+package apis
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how long to wait before restarting a crashed plugin; the delay doubles
+	// with every crash up to the maximum
+	pluginMinBackoff = 1 * time.Second
+	pluginMaxBackoff = 1 * time.Minute
+	// how long a plugin has to exit after its stdin has been closed
+	pluginStopTimeout = 2 * time.Second
+	// how long a plugin has to answer a request
+	pluginCallTimeout = 5 * time.Second
+)
+
+// PluginSettings is the section of a plugin in the `plugins` section of the
+// config file.
+type PluginSettings struct {
+	// the executable and its arguments
+	Command []string
+	// passed to the plugin as is
+	Settings any
+}
+
+// PluginState is what a plugin wants to show on the board.
+type PluginState struct {
+	// the color code or RGB color of every LED the plugin uses; "0" turns an
+	// LED off
+	LEDs map[string]string `json:"leds"`
+	// anything else the plugin publishes, e.g. for the debug server
+	Data any `json:"data,omitempty"`
+}
+
+// Gesture is a gesture recognized by the controller.
+type Gesture struct {
+	Inputs []string `json:"inputs"`
+	Kind   string   `json:"kind"`
+	Value  int      `json:"value,omitempty"`
+}
+
+// GestureListener is implemented by integrations that want to know about every
+// gesture. HandleGesture is called on the main loop and must not block.
+type GestureListener interface {
+	HandleGesture(g Gesture)
+}
+
+// DynamicActions is implemented by integrations that register their actions
+// while they run. Action returns an action even if it has not been registered
+// yet so it can be bound in the keymap.
+type DynamicActions interface {
+	Action(name string) Action
+}
+
+// FindAction looks up an action of an integration by name.
+func FindAction(integration Integration, name string) (Action, bool) {
+	if action, ok := integration.Actions()[name]; ok {
+		return action, true
+	}
+	if dynamic, ok := integration.(DynamicActions); ok {
+		return dynamic.Action(name), true
+	}
+	return Action{}, false
+}
+
+// ConfigurePlugins creates the plugins from the `plugins` section of the
+// config file.
+func ConfigurePlugins(sections map[string]PluginSettings) ([]Integration, error) {
+	var plugins []Integration
+	for name, settings := range sections {
+		if name == "" || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("plugins: invalid name: %q", name)
+		}
+		if Registered(name) {
+			return nil, fmt.Errorf("plugins: %s is the name of an integration", name)
+		}
+		if len(settings.Command) == 0 || settings.Command[0] == "" {
+			return nil, fmt.Errorf("plugins: %s: no command specified", name)
+		}
+		plugins = append(plugins, &plugin{service: newService(name), settings: settings})
+	}
+	return plugins, nil
+}
+
+// plugin runs an executable which talks JSON-RPC 2.0 on its stdin and stdout,
+// one message per line. The plugin sends `publish` notifications with a
+// PluginState and `registerAction` notifications with the name of an action
+// and whether it is a turn action. The controller sends an `initialize`
+// notification with the plugin's name and settings after starting it, a
+// `gesture` notification for every gesture and a `runAction` request with
+// the name of an action and the gesture's value to run an action. Plugins
+// are restarted when they exit and should exit once their stdin is closed.
+type plugin struct {
+	service
+	settings PluginSettings
+	conn     *pluginConn
+	connMux  sync.Mutex
+}
+
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+const rpcMethodNotFound = -32601
+
+type actionParams struct {
+	Name  string `json:"name"`
+	Turn  bool   `json:"turn,omitempty"`
+	Value int    `json:"value,omitempty"`
+}
+
+// pluginConn is the connection to a running plugin process.
+type pluginConn struct {
+	out     chan []byte
+	done    chan struct{}
+	actions map[string]bool
+	pending map[int64]chan rpcMessage
+	nextID  int64
+	mux     sync.Mutex
+}
+
+func (p *plugin) Start(ctx context.Context) <-chan any {
+	stateChan := make(chan PluginState)
+	p.start(func() {
+		p.run(ctx, stateChan)
+	})
+	return relay(ctx, &p.service, stateChan)
+}
+
+// Actions returns the actions registered by the plugin.
+func (p *plugin) Actions() map[string]Action {
+	conn := p.current()
+	if conn == nil {
+		return nil
+	}
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	actions := make(map[string]Action)
+	for name, turn := range conn.actions {
+		actions[name] = Action{Turn: turn, Run: p.Action(name).Run}
+	}
+	return actions
+}
+
+// Action returns an action that can be bound to any gesture. It fails unless
+// the plugin has registered it.
+func (p *plugin) Action(name string) Action {
+	return Action{Any: true, Run: func(ctx context.Context, value int) error {
+		conn := p.current()
+		if conn == nil {
+			return errors.New("plugin is not running")
+		}
+		conn.mux.Lock()
+		_, ok := conn.actions[name]
+		conn.mux.Unlock()
+		if !ok {
+			return fmt.Errorf("action %s has not been registered", name)
+		}
+		return conn.call(ctx, "runAction", actionParams{Name: name, Value: value})
+	}}
+}
+
+func (p *plugin) HandleGesture(g Gesture) {
+	if conn := p.current(); conn != nil {
+		conn.notify("gesture", g)
+	}
+}
+
+func (p *plugin) current() *pluginConn {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	return p.conn
+}
+
+func (p *plugin) setCurrent(conn *pluginConn) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	p.conn = conn
+}
+
+// run keeps the plugin running until ctx is cancelled.
+func (p *plugin) run(ctx context.Context, stateChan chan<- PluginState) {
+	backoff := pluginMinBackoff
+	for {
+		started := time.Now()
+		state, err := p.runProcess(ctx, stateChan)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+		log.Printf("plugin %s: %v\n", p.name, err)
+		p.setHealth(err)
+		// turn off whatever the crashed plugin showed
+		leds := make(map[string]string)
+		for led := range state.LEDs {
+			leds[led] = "0"
+		}
+		if !send(ctx, stateChan, PluginState{LEDs: leds}) {
+			return
+		}
+		if time.Since(started) > pluginMaxBackoff {
+			backoff = pluginMinBackoff
+		}
+		log.Printf("restarting plugin %s in %v\n", p.name, backoff)
+		if !sleep(ctx, backoff) {
+			return
+		}
+		backoff = min(backoff*2, pluginMaxBackoff)
+	}
+}
+
+// runProcess runs the plugin process until it exits and returns the last
+// state it published.
+func (p *plugin) runProcess(ctx context.Context, stateChan chan<- PluginState) (PluginState, error) {
+	state := PluginState{LEDs: make(map[string]string)}
+	cmd := exec.CommandContext(ctx, p.settings.Command[0], p.settings.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return state, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return state, err
+	}
+	// closing stdin asks the plugin to exit; it is killed if it does not
+	cmd.Cancel = stdin.Close
+	cmd.WaitDelay = pluginStopTimeout
+	if err := cmd.Start(); err != nil {
+		return state, err
+	}
+	log.Printf("started plugin %s\n", p.name)
+
+	conn := &pluginConn{
+		out:     make(chan []byte, 16),
+		done:    make(chan struct{}),
+		actions: make(map[string]bool),
+		pending: make(map[int64]chan rpcMessage),
+	}
+	go func() {
+		for {
+			select {
+			case <-conn.done:
+				return
+			case line := <-conn.out:
+				if _, err := stdin.Write(line); err != nil {
+					log.Printf("plugin %s: write failed: %v\n", p.name, err)
+					return
+				}
+			}
+		}
+	}()
+	conn.notify("initialize", map[string]any{"name": p.name, "settings": jsonValue(p.settings.Settings)})
+	p.setCurrent(conn)
+	p.setHealth(nil)
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf("plugin %s: invalid message: %v\n", p.name, err)
+			continue
+		}
+		if msg.Method == "" {
+			conn.resolve(msg)
+			continue
+		}
+		err := p.handle(ctx, conn, &state, stateChan, msg)
+		if err != nil {
+			log.Printf("plugin %s: %s failed: %v\n", p.name, msg.Method, err)
+		}
+		conn.reply(msg.ID, err)
+	}
+
+	p.setCurrent(nil)
+	conn.close()
+	// the pipe is closed once the process exits
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		log.Printf("plugin %s: read failed: %v\n", p.name, err)
+	}
+	return state, cmd.Wait()
+}
+
+// handle handles a notification or request sent by the plugin.
+func (p *plugin) handle(ctx context.Context, conn *pluginConn, state *PluginState, stateChan chan<- PluginState, msg rpcMessage) error {
+	switch msg.Method {
+	case "publish":
+		var published PluginState
+		if err := json.Unmarshal(msg.Params, &published); err != nil {
+			return err
+		}
+		// only the LEDs that changed have to be published
+		leds := maps.Clone(state.LEDs)
+		maps.Copy(leds, published.LEDs)
+		data := state.Data
+		if published.Data != nil {
+			data = published.Data
+		}
+		*state = PluginState{LEDs: leds, Data: data}
+		send(ctx, stateChan, *state)
+	case "registerAction":
+		var params actionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return err
+		}
+		if params.Name == "" {
+			return errors.New("no name specified")
+		}
+		conn.mux.Lock()
+		conn.actions[params.Name] = params.Turn
+		conn.mux.Unlock()
+		log.Printf("plugin %s registered action %s\n", p.name, params.Name)
+	default:
+		return &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + msg.Method}
+	}
+	return nil
+}
+
+// jsonValue converts the mappings in a value decoded from the config file,
+// whose keys are interface{}, to maps that can be encoded as JSON objects.
+func jsonValue(value any) any {
+	switch v := value.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[key] = jsonValue(value)
+		}
+		return m
+	case []any:
+		s := make([]any, len(v))
+		for i, value := range v {
+			s[i] = jsonValue(value)
+		}
+		return s
+	}
+	return value
+}
+
+// notify sends a notification unless too many messages are queued already.
+func (c *pluginConn) notify(method string, params any) {
+	c.write(rpcMessage{Method: method}, params)
+}
+
+// call sends a request and waits for the response.
+func (c *pluginConn) call(ctx context.Context, method string, params any) error {
+	c.mux.Lock()
+	c.nextID++
+	id := c.nextID
+	response := make(chan rpcMessage, 1)
+	c.pending[id] = response
+	c.mux.Unlock()
+	defer func() {
+		c.mux.Lock()
+		delete(c.pending, id)
+		c.mux.Unlock()
+	}()
+
+	if !c.write(rpcMessage{ID: &id, Method: method}, params) {
+		return errors.New("plugin is busy")
+	}
+	timer := time.NewTimer(pluginCallTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-response:
+		if msg.Error != nil {
+			return msg.Error
+		}
+		return nil
+	case <-c.done:
+		return errors.New("plugin exited")
+	case <-timer.C:
+		return errors.New("plugin did not respond")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reply responds to a request; notifications do not get a response.
+func (c *pluginConn) reply(id *int64, err error) {
+	if id == nil {
+		return
+	}
+	msg := rpcMessage{ID: id}
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{Code: -32000, Message: err.Error()}
+		}
+		msg.Error = rpcErr
+	} else {
+		msg.Result = json.RawMessage("null")
+	}
+	c.write(msg, nil)
+}
+
+func (c *pluginConn) write(msg rpcMessage, params any) bool {
+	msg.JSONRPC = "2.0"
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			log.Printf("could not encode %s: %v\n", msg.Method, err)
+			return false
+		}
+		msg.Params = data
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("could not encode %s: %v\n", msg.Method, err)
+		return false
+	}
+	select {
+	case c.out <- append(data, '\n'):
+		return true
+	case <-c.done:
+		return false
+	default:
+		log.Printf("dropping %s: the plugin does not keep up\n", msg.Method)
+		return false
+	}
+}
+
+func (c *pluginConn) resolve(msg rpcMessage) {
+	if msg.ID == nil {
+		return
+	}
+	c.mux.Lock()
+	response, ok := c.pending[*msg.ID]
+	c.mux.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case response <- msg:
+	default:
+		// the request has been answered already
+	}
+}
+
+func (c *pluginConn) close() {
+	close(c.done)
+}
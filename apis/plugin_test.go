@@ -0,0 +1,141 @@
+package apis
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TestPluginProcess is not a real test but the plugin run by TestPlugin. It
+// publishes the params of `initialize` as its data, registers a `ping` action
+// which succeeds and a `fail` action which fails.
+func TestPluginProcess(t *testing.T) {
+	if os.Getenv("CONTROLLER_TEST_PLUGIN") != "1" {
+		return
+	}
+	send := func(msg map[string]any) {
+		msg["jsonrpc"] = "2.0"
+		data, _ := json.Marshal(msg)
+		fmt.Printf("%s\n", data)
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var msg rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			os.Exit(2)
+		}
+		switch msg.Method {
+		case "initialize":
+			send(map[string]any{"method": "registerAction", "params": map[string]any{"name": "ping"}})
+			send(map[string]any{"method": "registerAction", "params": map[string]any{"name": "fail"}})
+			send(map[string]any{"method": "publish", "params": map[string]any{
+				"leds": map[string]string{"LED1": "#ff0000"},
+				"data": msg.Params,
+			}})
+		case "runAction":
+			var params actionParams
+			json.Unmarshal(msg.Params, &params)
+			if params.Name == "ping" && params.Value == 3 {
+				send(map[string]any{"id": msg.ID, "result": nil})
+			} else {
+				send(map[string]any{"id": msg.ID, "error": map[string]any{"code": -32000, "message": "failed"}})
+			}
+		}
+	}
+	os.Exit(0)
+}
+
+func TestPlugin(t *testing.T) {
+	var settings PluginSettings
+	config := `
+command: []
+settings:
+  servers:
+    - host: irc.example.com
+      port: 6697
+  channels:
+    "#go": 1
+`
+	if err := yaml.Unmarshal([]byte(config), &settings); err != nil {
+		t.Fatal(err)
+	}
+	settings.Command = []string{os.Args[0], "-test.run=^TestPluginProcess$"}
+	t.Setenv("CONTROLLER_TEST_PLUGIN", "1")
+	plugins, err := ConfigurePlugins(map[string]PluginSettings{"test": settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := plugins[0].(*plugin)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stateChan := p.Start(ctx)
+	var state PluginState
+	select {
+	case value := <-stateChan:
+		state = value.(PluginState)
+	case <-time.After(5 * time.Second):
+		t.Fatal("plugin did not publish its state")
+	}
+
+	// the mappings of the settings are sent as JSON objects
+	want := map[string]any{
+		"name": "test",
+		"settings": map[string]any{
+			"servers":  []any{map[string]any{"host": "irc.example.com", "port": float64(6697)}},
+			"channels": map[string]any{"#go": float64(1)},
+		},
+	}
+	if !reflect.DeepEqual(state.Data, want) {
+		t.Errorf("got initialize params %v, want %v", state.Data, want)
+	}
+	if !reflect.DeepEqual(state.LEDs, map[string]string{"LED1": "#ff0000"}) {
+		t.Errorf("got leds %v", state.LEDs)
+	}
+
+	// the actions were registered before the state was published
+	if actions := p.Actions(); len(actions) != 2 {
+		t.Errorf("got actions %v, want ping and fail", actions)
+	}
+	if err := p.Action("ping").Run(ctx, 3); err != nil {
+		t.Errorf("ping failed: %v", err)
+	}
+	if err := p.Action("fail").Run(ctx, 0); err == nil {
+		t.Error("fail did not fail")
+	}
+	if err := p.Action("unknown").Run(ctx, 0); err == nil {
+		t.Error("unregistered action did not fail")
+	}
+
+	// the plugin process exits once the integration is stopped
+	cancel()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	if err := p.Wait(waitCtx); err != nil {
+		t.Errorf("plugin did not stop: %v", err)
+	}
+}
+
+func TestJSONValue(t *testing.T) {
+	value := map[any]any{
+		"list":   []any{map[any]any{1: "one"}},
+		"nested": map[string]any{"inner": map[any]any{true: "yes"}},
+	}
+	want := map[string]any{
+		"list":   []any{map[string]any{"1": "one"}},
+		"nested": map[string]any{"inner": map[string]any{"true": "yes"}},
+	}
+	if got := jsonValue(value); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := json.Marshal(jsonValue(value)); err != nil {
+		t.Error(err)
+	}
+}
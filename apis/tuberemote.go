@@ -1,11 +1,14 @@
 package apis
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -46,95 +49,237 @@ var (
 			return u.Scheme == "moz-extension"
 		},
 	}
-	broadcastChan    = make(chan string)
-	eventChan        = make(chan TubeRemoteState)
+	// held while a server is running so a restarted one waits for the port
+	serverMux sync.Mutex
+)
+
+// tubeRemoteServer is the state of one run of the websocket server. A
+// restarted integration gets a new one so a server which is still shutting
+// down cannot interfere with it.
+type tubeRemoteServer struct {
+	// messages for the extension, written by a single goroutine
+	commands chan string
+	// guards the fields below, which are used by the websocket handlers, the
+	// writer and the status ticker
+	mux              sync.Mutex
 	activeConn       *websocket.Conn
-	initialStateSent = false
+	initialStateSent bool
 	lastState        TubeRemoteState
-)
+}
+
+func newTubeRemoteServer() *tubeRemoteServer {
+	return &tubeRemoteServer{commands: make(chan string)}
+}
+
+func (s *tubeRemoteServer) conn() *websocket.Conn {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.activeConn
+}
+
+// connect makes c the active connection and closes the previous one.
+func (s *tubeRemoteServer) connect(c *websocket.Conn) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeConn != nil {
+		log.Printf("closing previous websocket conn %p\n", s.activeConn)
+		s.activeConn.Close()
+	}
+	s.activeConn = c
+}
+
+func (s *tubeRemoteServer) disconnect(c *websocket.Conn) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	c.Close()
+	if c == s.activeConn {
+		s.activeConn = nil
+	}
+}
 
-func ws(w http.ResponseWriter, r *http.Request) {
+// update records a state received on c and tells whether it is new and should
+// be sent on.
+func (s *tubeRemoteServer) update(c *websocket.Conn, newState TubeRemoteState) (changed, active bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if c != s.activeConn {
+		return false, false
+	}
+	if newState == s.lastState && s.initialStateSent {
+		return false, true
+	}
+	s.lastState = newState
+	s.initialStateSent = true
+	return true, true
+}
+
+func (s *tubeRemoteServer) ws(ctx context.Context, eventChan chan<- TubeRemoteState, w http.ResponseWriter, r *http.Request) {
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("websocket upgrade failed: %s\n", err)
 		return
 	}
-	defer func() {
-		c.Close()
-		if c == activeConn {
-			activeConn = nil
-		}
-	}()
-	if activeConn != nil {
-		log.Printf("closing previous websocket conn %p\n", activeConn)
-		activeConn.Close()
-	}
-	activeConn = c
+	defer s.disconnect(c)
+	s.connect(c)
 	for {
 		_, message, err := c.ReadMessage()
 		if err != nil {
 			log.Printf("websocket read failed: %s\n", err)
 			break
 		}
-		if c != activeConn {
+		var newState TubeRemoteState
+		if err := json.Unmarshal(message, &newState); err != nil {
+			log.Printf("could not unmarshal tuberemote message: %v\n", err)
+			continue
+		}
+		changed, active := s.update(c, newState)
+		if !active {
 			// not sure if this can happen, but let's ignore such cases just in case
 			log.Println("ignoring websocket read on old socket")
 			break
 		}
-		var newState TubeRemoteState
-		if err := json.Unmarshal(message, &newState); err != nil {
-			log.Printf("could not unmarshal tuberemote message: %v\n", err)
-		} else if newState != lastState || !initialStateSent {
-			eventChan <- newState
-			lastState = newState
-			initialStateSent = true
+		if changed && !send(ctx, eventChan, newState) {
+			break
 		}
 	}
 }
 
-func tubeRemoteWriter() {
-	for msg := range broadcastChan {
-		if activeConn == nil {
-			log.Printf("discarding %s\n", msg)
-			continue
-		}
-		if err := activeConn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
-			log.Printf("websocket write failed: %s\n", err)
+// writer sends the commands to the extension until ctx is cancelled.
+func (s *tubeRemoteServer) writer(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.commands:
+			conn := s.conn()
+			if conn == nil {
+				log.Printf("discarding %s\n", msg)
+				continue
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+				log.Printf("websocket write failed: %s\n", err)
+			}
 		}
 	}
 }
 
-func tubeRemoteListener(port int) {
-	err := http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", port), nil)
-	log.Fatalf("tuberemote server exited: %v", err)
+func tubeRemoteListener(server *http.Server) error {
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		log.Println("tuberemote server stopped")
+		return nil
+	}
+	log.Printf("tuberemote server exited: %v\n", err)
+	return err
 }
 
-func RunTubeRemote(port int) <-chan TubeRemoteState {
-	http.HandleFunc("/ws", ws)
-	go func() {
-		for range time.Tick(250 * time.Millisecond) {
-			if activeConn != nil {
-				broadcastChan <- `{"action": "getStatus"}`
-			}
+func init() {
+	Register("tuberemote", "tubeRemotePort", newTubeRemoteIntegration)
+}
+
+// tubeRemoteIntegration controls a YouTube tab through the TubeRemote
+// extension. Its state is a TubeRemoteState.
+type tubeRemoteIntegration struct {
+	service
+	port int
+	// the server of the current run, guarded by mux
+	server *tubeRemoteServer
+	mux    sync.Mutex
+}
+
+func newTubeRemoteIntegration(settings *Settings) (Integration, error) {
+	var port int
+	if settings != nil {
+		if err := settings.Decode(&port); err != nil {
+			return nil, err
 		}
-	}()
-	go tubeRemoteWriter()
-	go tubeRemoteListener(port)
-	return eventChan
+	}
+	if port == 0 {
+		return nil, nil
+	}
+	if port < 1024 || port > 65535 {
+		return nil, errors.New("invalid port specified")
+	}
+	return &tubeRemoteIntegration{service: newService("tuberemote"), port: port}, nil
 }
 
-func TubeRemoteTogglePause() {
-	broadcastChan <- `{"action": "togglePlayback"}`
+func (t *tubeRemoteIntegration) Start(ctx context.Context) <-chan any {
+	server := newTubeRemoteServer()
+	t.mux.Lock()
+	t.server = server
+	t.mux.Unlock()
+	return relay(ctx, &t.service, server.run(ctx, &t.service, t.port))
 }
 
-func TubeRemoteStop() {
-	broadcastChan <- `{"action": "stopPlayback"}`
+func (t *tubeRemoteIntegration) Actions() map[string]Action {
+	return map[string]Action{
+		"togglePause": {Run: func(ctx context.Context, value int) error {
+			return t.command(ctx, `{"action": "togglePlayback"}`)
+		}},
+		"stop": {Run: func(ctx context.Context, value int) error {
+			return t.command(ctx, `{"action": "stopPlayback"}`)
+		}},
+		"volume": {Turn: true, Run: func(ctx context.Context, value int) error {
+			return t.command(ctx, fmt.Sprintf(`{"action": "changeVolume", "delta": %d}`, value*2))
+		}},
+		"seek": {Turn: true, Run: func(ctx context.Context, value int) error {
+			return t.command(ctx, fmt.Sprintf(`{"action": "seekBy", "delta": %d}`, value*5))
+		}},
+	}
 }
 
-func TubeRemoteAdjustVolume(delta int) {
-	broadcastChan <- fmt.Sprintf(`{"action": "changeVolume", "delta": %d}`, delta)
+func (t *tubeRemoteIntegration) command(ctx context.Context, msg string) error {
+	t.mux.Lock()
+	server := t.server
+	t.mux.Unlock()
+	if server == nil {
+		return errors.New("tuberemote is not running")
+	}
+	if !send(ctx, server.commands, msg) {
+		return ctx.Err()
+	}
+	return nil
 }
 
-func TubeRemoteSeek(delta int) {
-	broadcastChan <- fmt.Sprintf(`{"action": "seekBy", "delta": %d}`, delta)
+// run runs the websocket server the TubeRemote extension connects to and
+// sends the state of the YouTube tab whenever it changes until ctx is
+// cancelled.
+func (s *tubeRemoteServer) run(ctx context.Context, svc *service, port int) <-chan TubeRemoteState {
+	eventChan := make(chan TubeRemoteState)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		s.ws(ctx, eventChan, w, r)
+	})
+	server := &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", port), Handler: mux}
+	svc.start(func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				server.Close()
+				// the websocket has been hijacked so closing the server does
+				// not close it
+				if conn := s.conn(); conn != nil {
+					conn.Close()
+				}
+				return
+			case <-ticker.C:
+				if s.conn() != nil {
+					send(ctx, s.commands, `{"action": "getStatus"}`)
+				}
+			}
+		}
+	})
+	svc.start(func() {
+		s.writer(ctx)
+	})
+	svc.start(func() {
+		serverMux.Lock()
+		defer serverMux.Unlock()
+		if err := tubeRemoteListener(server); err != nil {
+			svc.setHealth(err)
+		}
+	})
+	return eventChan
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thiefmaster/controller/apis"
+	"github.com/thiefmaster/controller/comm"
+	"github.com/thiefmaster/controller/hardware"
+	"github.com/thiefmaster/controller/schedule"
+)
+
+// the behavior used while no rule of the schedule applies
+const defaultBehavior = "default"
+
+// behavior changes what the controller does, e.g. during quiet hours.
+// Behaviors are switched by the `schedule` section of the config file.
+type behavior struct {
+	// LED layers which are not shown, e.g. notification to hide the
+	// notification blinkers or feedback to hide most animations
+	Hide []ledLayer
+	// scales all RGB colors, from 0 to 1
+	Brightness float64
+	// integrations which are stopped
+	Disable []string
+	// what showBehavior shows on the LED bar
+	Color string
+}
+
+// scheduleRule switches to a behavior whenever its cron expression matches.
+type scheduleRule struct {
+	At       string
+	Behavior string
+	spec     schedule.Spec
+}
+
+func (c *appConfig) loadBehaviors() error {
+	if c.Behaviors == nil {
+		c.Behaviors = make(map[string]*behavior)
+	}
+	if _, ok := c.Behaviors[defaultBehavior]; !ok {
+		c.Behaviors[defaultBehavior] = &behavior{}
+	}
+	for name, b := range c.Behaviors {
+		for _, layer := range b.Hide {
+			if layer == layerBase || layer == layerAlert {
+				return fmt.Errorf("behavior %s: the %s layer cannot be hidden", name, layer)
+			}
+		}
+		if b.Brightness < 0 || b.Brightness > 1 {
+			return fmt.Errorf("behavior %s: invalid brightness: %v", name, b.Brightness)
+		} else if b.Brightness == 0 {
+			b.Brightness = 1
+		} else if b.Brightness < 1 && !hasRGB(c.profile) {
+			// color codes cannot be dimmed
+			return fmt.Errorf("behavior %s: brightness needs leds which support rgb colors", name)
+		}
+		for _, integration := range b.Disable {
+			if _, ok := c.Plugins[integration]; !ok && !apis.Registered(integration) {
+				return fmt.Errorf("behavior %s: unknown integration: %s", name, integration)
+			}
+		}
+		if b.Color == "" {
+			b.Color = "G"
+		}
+		if err := validateFrameColor(b.Color); err != nil || b.Color == "toggle" || b.Color == "0" {
+			return fmt.Errorf("behavior %s: invalid color: %s", name, b.Color)
+		}
+	}
+	// showBehavior tells behaviors apart by their position on the LED bar
+	c.behaviorOrder = []string{defaultBehavior}
+	for name := range c.Behaviors {
+		if name != defaultBehavior {
+			c.behaviorOrder = append(c.behaviorOrder, name)
+		}
+	}
+	slices.Sort(c.behaviorOrder[1:])
+	if bar := c.profile.Bar(); len(bar) > 0 && len(c.behaviorOrder) > len(bar) {
+		return fmt.Errorf("too many behaviors: the led bar can only show %d", len(bar))
+	}
+	for _, rule := range c.Schedule {
+		var err error
+		if rule.spec, err = schedule.Parse(rule.At); err != nil {
+			return err
+		}
+		if _, ok := c.Behaviors[rule.Behavior]; !ok {
+			return fmt.Errorf("unknown behavior: %s", rule.Behavior)
+		}
+	}
+	return nil
+}
+
+// hasRGB tells whether any LED of a profile can show RGB colors.
+func hasRGB(profile *hardware.Profile) bool {
+	for _, led := range profile.LEDs {
+		if strings.IndexByte(led.Colors, '#') != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// activeBehavior returns the behavior of the schedule rule which matched
+// last. If several rules matched at the same time the last one wins.
+func (c *appConfig) activeBehavior(now time.Time) string {
+	name := defaultBehavior
+	var latest time.Time
+	for _, rule := range c.Schedule {
+		if t, ok := rule.spec.Prev(now); ok && !t.Before(latest) {
+			latest = t
+			name = rule.Behavior
+		}
+	}
+	return name
+}
+
+func (s *appState) behavior() *behavior {
+	return s.config.Behaviors[s.behaviorName]
+}
+
+// integrationEnabled tells whether an integration should run with the current
+// config and behavior.
+func (s *appState) integrationEnabled(name string) bool {
+	_, ok := s.config.integration(name)
+	return ok && !slices.Contains(s.behavior().Disable, name)
+}
+
+// updateBehavior switches to the behavior the schedule wants now, e.g. after
+// reloading the config file.
+func updateBehavior(ctx context.Context, state *appState) {
+	name := state.config.activeBehavior(time.Now())
+	if name != state.behaviorName {
+		log.Printf("switching to %s behavior\n", name)
+	}
+	state.behaviorName = name
+	updateVisibility(state)
+	if state.started {
+		updateIntegrations(ctx, state)
+	}
+}
+
+// updateVisibility hides the LED layers the behavior hides.
+func updateVisibility(state *appState) {
+	b := state.behavior()
+	var hidden [numLayers]bool
+	for _, layer := range b.Hide {
+		hidden[layer] = true
+	}
+	state.leds.show(hidden, b.Brightness)
+}
+
+// runSchedule checks at the start of every minute whether the behavior has to
+// change until ctx is cancelled.
+func runSchedule(ctx context.Context, state *appState) {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			state.post(ctx, func() {
+				updateBehavior(ctx, state)
+			})
+		}
+	}
+}
+
+// showBehavior lights up the LED of the active behavior on the LED bar, in the
+// color of the behavior. The position tells behaviors apart even on LEDs that
+// cannot show the color.
+func showBehavior(state *appState, cmdChan chan<- comm.Command) {
+	log.Printf("active behavior: %s\n", state.behaviorName)
+	bar := state.profile.Bar()
+	if len(bar) == 0 {
+		return
+	}
+	index := slices.Index(state.config.behaviorOrder, state.behaviorName)
+	// shown on the alert layer so hidden layers do not hide it
+	anim := animation{Layer: layerAlert}
+	for i, led := range bar {
+		color := "0"
+		if i == index {
+			color = state.behavior().Color
+		}
+		anim.Frames = append(anim.Frames, keyframe{LED: led, Color: color})
+	}
+	anim.Frames[len(anim.Frames)-1].Duration = 1 * time.Second
+	state.animator.start("behavior", anim)
+}
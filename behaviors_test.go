@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thiefmaster/controller/hardware"
+)
+
+func TestActiveBehavior(t *testing.T) {
+	config := &appConfig{
+		profile: hardware.Default(),
+		Behaviors: map[string]*behavior{
+			"quiet":   {Hide: []ledLayer{layerNotification}},
+			"weekend": {Disable: []string{"mattermost"}},
+		},
+		Schedule: []*scheduleRule{
+			{At: "0 19 * * *", Behavior: "quiet"},
+			{At: "0 7 * * mon-fri", Behavior: "default"},
+			{At: "0 7 * * sat,sun", Behavior: "weekend"},
+			// matches at the same time as the first rule on Fridays
+			{At: "0 19 * * fri", Behavior: "weekend"},
+		},
+	}
+	if err := config.loadBehaviors(); err != nil {
+		t.Fatal(err)
+	}
+	// 2024-01-01 is a Monday
+	tests := []struct {
+		now  time.Time
+		want string
+	}{
+		{time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local), "default"},
+		{time.Date(2024, 1, 1, 19, 0, 0, 0, time.Local), "quiet"},
+		{time.Date(2024, 1, 2, 6, 59, 0, 0, time.Local), "quiet"},
+		{time.Date(2024, 1, 2, 7, 0, 0, 0, time.Local), "default"},
+		// the last of several rules matching at the same time wins
+		{time.Date(2024, 1, 5, 20, 0, 0, 0, time.Local), "weekend"},
+		{time.Date(2024, 1, 6, 12, 0, 0, 0, time.Local), "weekend"},
+		{time.Date(2024, 1, 6, 19, 30, 0, 0, time.Local), "quiet"},
+	}
+	for _, tt := range tests {
+		if got := config.activeBehavior(tt.now); got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.now, got, tt.want)
+		}
+	}
+
+	// without a schedule the default behavior is always active
+	config.Schedule = nil
+	if got := config.activeBehavior(time.Now()); got != defaultBehavior {
+		t.Errorf("got %s without a schedule, want %s", got, defaultBehavior)
+	}
+}
+
+func TestLoadBehaviors(t *testing.T) {
+	rgbProfile := hardware.Default()
+	rgbProfile.LEDs[0].Colors = "RGY#"
+	tests := []struct {
+		name      string
+		profile   *hardware.Profile
+		behaviors map[string]*behavior
+		schedule  []*scheduleRule
+		wantErr   bool
+	}{
+		{name: "no behaviors", profile: hardware.Default()},
+		{
+			name:      "dimming rgb leds",
+			profile:   rgbProfile,
+			behaviors: map[string]*behavior{"quiet": {Brightness: 0.3}},
+		},
+		{
+			name:      "dimming without rgb leds",
+			profile:   hardware.Default(),
+			behaviors: map[string]*behavior{"quiet": {Brightness: 0.3}},
+			wantErr:   true,
+		},
+		{
+			name:      "full brightness without rgb leds",
+			profile:   hardware.Default(),
+			behaviors: map[string]*behavior{"quiet": {Brightness: 1}},
+		},
+		{
+			name:      "invalid brightness",
+			profile:   rgbProfile,
+			behaviors: map[string]*behavior{"quiet": {Brightness: 2}},
+			wantErr:   true,
+		},
+		{
+			name:      "hiding the base layer",
+			profile:   hardware.Default(),
+			behaviors: map[string]*behavior{"quiet": {Hide: []ledLayer{layerBase}}},
+			wantErr:   true,
+		},
+		{
+			name:    "more behaviors than bar leds",
+			profile: hardware.Default(),
+			behaviors: map[string]*behavior{
+				"a": {}, "b": {}, "c": {}, "d": {}, "e": {},
+			},
+			wantErr: true,
+		},
+		{
+			name:     "unknown behavior in the schedule",
+			profile:  hardware.Default(),
+			schedule: []*scheduleRule{{At: "0 19 * * *", Behavior: "quiet"}},
+			wantErr:  true,
+		},
+		{
+			name:      "invalid cron expression",
+			profile:   hardware.Default(),
+			behaviors: map[string]*behavior{"quiet": {}},
+			schedule:  []*scheduleRule{{At: "0 25 * * *", Behavior: "quiet"}},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &appConfig{profile: tt.profile, Behaviors: tt.behaviors, Schedule: tt.schedule}
+			if err := config.loadBehaviors(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
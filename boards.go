@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/thiefmaster/controller/comm"
+	"github.com/thiefmaster/controller/hardware"
+)
+
+// boardConfig describes one of the rotaryboards attached to the controller.
+type boardConfig struct {
+	ID      string
+	Port    string
+	Profile string
+	// Names maps the names of inputs and leds in the board's hardware profile
+	// to the names used by the controller. If it is empty all inputs and leds
+	// keep their own names; otherwise only the mapped leds are used and the
+	// other inputs can only be bound in the board's keymap.
+	Names map[string]string
+	// Keymap binds gestures on the inputs of this board, using the names
+	// from its hardware profile. It takes precedence over the global keymap.
+	Keymap  map[string]string
+	profile *hardware.Profile
+}
+
+func (b *boardConfig) loadProfile() error {
+	if b.Profile == "" {
+		b.profile = hardware.Default()
+	} else {
+		profile, err := hardware.Load(b.Profile)
+		if err != nil {
+			return err
+		}
+		b.profile = profile
+	}
+	for name, mapped := range b.Names {
+		_, isInput := b.profile.Input(name)
+		_, isLED := b.profile.LED(name)
+		if !isInput && !isLED {
+			return fmt.Errorf("board %s has no input or led %s", b.ID, name)
+		}
+		if mapped == "" {
+			return fmt.Errorf("board %s maps %s to an empty name", b.ID, name)
+		}
+		if strings.ContainsAny(mapped, "/+ ") {
+			return fmt.Errorf("board %s maps %s to an invalid name: %s", b.ID, name, mapped)
+		}
+	}
+	return nil
+}
+
+// mappedName returns the name the controller uses for an input or led of the
+// board, or an empty string if it is not used.
+func (b *boardConfig) mappedName(name string) string {
+	if len(b.Names) == 0 {
+		return name
+	}
+	return b.Names[name]
+}
+
+// inputName returns the name the controller uses for an input of the board.
+// Inputs that are not mapped are qualified with the board id, e.g.
+// `desk/button3`, so they can still be bound in the board's keymap.
+func (b *boardConfig) inputName(name string) string {
+	if mapped := b.mappedName(name); mapped != "" {
+		return mapped
+	}
+	return b.ID + "/" + name
+}
+
+// sameHardware tells whether two lists of boards connect to the same boards
+// with the same profiles and names, which cannot change without a restart.
+func sameHardware(a, b []*boardConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := *a[i], *b[i]
+		x.Keymap, y.Keymap = nil, nil
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// boardElement is an input or led on a specific board.
+type boardElement struct {
+	board *board
+	index int
+}
+
+type board struct {
+	config       *boardConfig
+	msgChan      <-chan comm.Message
+	cmdChan      chan<- comm.Command
+	ready        bool
+	capabilities *comm.Capabilities
+	// inputs maps the protocol indexes of the board's inputs to the indexes in
+	// the combined profile
+	inputs map[int]int
+	// inputNames maps the names of the board's inputs in its own profile to
+	// their names in the combined profile
+	inputNames map[string]string
+}
+
+// boardSet combines several boards into one. The controller sees a single
+// hardware profile containing the inputs and mapped leds of all boards and
+// messages and commands are translated from/to the board they belong to.
+type boardSet struct {
+	boards  []*board
+	profile *hardware.Profile
+	leds    map[int]boardElement
+}
+
+func newBoardSet(configs []*boardConfig) (*boardSet, error) {
+	s := &boardSet{leds: make(map[int]boardElement)}
+	var ids []string
+	inputBoards := make(map[string]string)
+	ledBoards := make(map[string]string)
+	profile := &hardware.Profile{}
+	for _, config := range configs {
+		b := &board{config: config, inputs: make(map[int]int), inputNames: make(map[string]string)}
+		s.boards = append(s.boards, b)
+		ids = append(ids, config.ID)
+		for _, input := range config.profile.Inputs {
+			name := config.inputName(input.Name)
+			if other, ok := inputBoards[name]; ok {
+				return nil, fmt.Errorf("input %s is mapped on boards %s and %s", name, other, config.ID)
+			}
+			inputBoards[name] = config.ID
+			index := len(profile.Inputs)
+			b.inputs[input.Index] = index
+			b.inputNames[input.Name] = name
+			profile.Inputs = append(profile.Inputs, hardware.Input{Name: name, Index: index, Kind: input.Kind})
+		}
+		for _, led := range config.profile.LEDs {
+			name := config.mappedName(led.Name)
+			if name == "" {
+				continue
+			}
+			if other, ok := ledBoards[name]; ok {
+				return nil, fmt.Errorf("led %s is mapped on boards %s and %s", name, other, config.ID)
+			}
+			ledBoards[name] = config.ID
+			index := len(profile.LEDs)
+			s.leds[index] = boardElement{board: b, index: led.Index}
+			profile.LEDs = append(profile.LEDs, hardware.LED{Name: name, Index: index, Colors: led.Colors, Bar: led.Bar})
+		}
+	}
+	profile.Name = strings.Join(ids, "+")
+	s.profile = profile
+	return s, nil
+}
+
+func (s *boardSet) board(id string) *board {
+	for _, b := range s.boards {
+		if b.config.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// inputNames returns the names of all inputs of a board.
+func (s *boardSet) inputNames(id string) []string {
+	b := s.board(id)
+	if b == nil {
+		return nil
+	}
+	var names []string
+	for _, index := range b.inputs {
+		names = append(names, s.profile.InputName(index))
+	}
+	return names
+}
+
+// keymap returns the bindings of a board's keymap with its inputs renamed to
+// their names in the combined profile.
+func (s *boardSet) keymap(b *board) (map[string]string, error) {
+	bindings := make(map[string]string)
+	for key, action := range b.config.Keymap {
+		inputSpec, gestureSpec, ok := strings.Cut(key, " ")
+		if !ok {
+			return nil, fmt.Errorf("board %s: invalid binding %q: expected `<input> <gesture>`", b.config.ID, key)
+		}
+		var inputs []string
+		for _, input := range strings.Split(inputSpec, "+") {
+			name, ok := b.inputNames[input]
+			if !ok {
+				return nil, fmt.Errorf("board %s: invalid binding %q: unknown input %s", b.config.ID, key, input)
+			}
+			inputs = append(inputs, name)
+		}
+		bindings[strings.Join(inputs, "+")+" "+gestureSpec] = action
+	}
+	return bindings, nil
+}
+
+// open merges the channels of all boards, which must have been opened before.
+// The returned channels use the indexes of the combined profile.
+func (s *boardSet) open() (<-chan comm.Message, chan<- comm.Command) {
+	msgChan := make(chan comm.Message, 8)
+	cmdChan := make(chan comm.Command, 8)
+	var wg sync.WaitGroup
+	for _, b := range s.boards {
+		wg.Add(1)
+		go func(b *board) {
+			defer wg.Done()
+			for msg := range b.msgChan {
+				msg.Board = b.config.ID
+				switch msg.Message {
+				case comm.ButtonPressed, comm.ButtonReleased, comm.KnobTurned:
+					index, ok := b.inputs[msg.Source]
+					if !ok {
+						continue
+					}
+					msg.Source = index
+				}
+				msgChan <- msg
+			}
+		}(b)
+	}
+	go func() {
+		wg.Wait()
+		close(msgChan)
+	}()
+	go func() {
+		for cmd := range cmdChan {
+			if cmd.IsReset() {
+				for _, b := range s.boards {
+					b.cmdChan <- cmd
+				}
+				continue
+			}
+			led, ok := s.leds[cmd.Target()]
+			if !ok {
+				log.Printf("ignoring command for unknown led %d\n", cmd.Target())
+				continue
+			}
+			led.board.cmdChan <- cmd.WithTarget(led.index)
+		}
+	}()
+	return msgChan, cmdChan
+}
@@ -0,0 +1,91 @@
+// rotarysim simulates a rotaryboard in the terminal so the controller can be
+// used without a real board attached.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"github.com/thiefmaster/controller/comm"
+	"github.com/thiefmaster/controller/hardware"
+)
+
+func main() {
+	listenAddr := flag.String("listen", "127.0.0.1:7000", "tcp address to listen on (use with a tcp:// port)")
+	usePTY := flag.Bool("pty", false, "create a pseudo-terminal instead of listening on tcp (use with a pty:// port)")
+	logPath := flag.String("log", "", "file to write the protocol log to")
+	profilePath := flag.String("profile", "", "hardware profile of the simulated board (defaults to the original rotaryboard)")
+	framed := flag.Bool("framed", false, "use framed lines with checksums and acknowledgements")
+	noise := flag.Float64("noise", 0, "probability (0-1) of corrupting data sent or received, to test framed lines")
+	flag.Parse()
+
+	profile := hardware.Default()
+	if *profilePath != "" {
+		var err error
+		if profile, err = hardware.Load(*profilePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	logOutput := io.Discard
+	if *logPath != "" {
+		f, err := os.Create(*logPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		logOutput = f
+	}
+	log.SetOutput(logOutput)
+
+	sim := newSimulator(profile, *framed, *noise)
+	if *usePTY {
+		master, path, err := comm.OpenPTY()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not create pty: %v\n", err)
+			os.Exit(1)
+		}
+		go func() {
+			// the master stays open so hosts can reconnect to the same path
+			for {
+				sim.setStatus(fmt.Sprintf("waiting on pty://%s", path))
+				waitForPTYHost(master)
+				sim.serve(master)
+			}
+		}()
+	} else {
+		ln, err := net.Listen("tcp", *listenAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not listen: %v\n", err)
+			os.Exit(1)
+		}
+		sim.setStatus(fmt.Sprintf("waiting on tcp://%s", ln.Addr()))
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					log.Fatalf("Accept: %v\n", err)
+				}
+				sim.setStatus(fmt.Sprintf("connected to %s", conn.RemoteAddr()))
+				go func() {
+					defer conn.Close()
+					sim.serve(conn)
+				}()
+			}
+		}()
+	}
+
+	restore, err := makeTerminalRaw()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not set up terminal: %v\n", err)
+		os.Exit(1)
+	}
+	defer restore()
+	sim.runKeyboard(os.Stdin)
+	fmt.Print("\x1b[2J\x1b[H")
+}
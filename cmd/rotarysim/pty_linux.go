@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitForPTYHost waits until a host has the slave side of the pty open. Once
+// the last host closed it, reading the master fails until the next one opens
+// it.
+func waitForPTYHost(master *os.File) {
+	for {
+		fds := []unix.PollFd{{Fd: int32(master.Fd()), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, 0); err != nil || fds[0].Revents&unix.POLLHUP == 0 {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
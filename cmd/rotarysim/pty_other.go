@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// waitForPTYHost is a no-op since ptys are only supported on linux.
+func waitForPTYHost(master *os.File) {}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thiefmaster/controller/comm"
+	"github.com/thiefmaster/controller/hardware"
+)
+
+// keys used to press the inputs of the board, in the order they are defined
+// in the hardware profile
+const inputKeys = "kqadwsefrgtzhyjuilop"
+
+type input struct {
+	hardware.Input
+	key byte
+}
+
+func capabilities(profile *hardware.Profile, framed bool) *comm.Capabilities {
+	caps := &comm.Capabilities{Protocol: 2, Firmware: "rotarysim", LEDs: make(map[int]string), Framing: framed}
+	for _, in := range profile.Inputs {
+		caps.Inputs = append(caps.Inputs, in.Index)
+	}
+	for _, led := range profile.LEDs {
+		caps.LEDs[led.Index] = led.Colors
+	}
+	return caps
+}
+
+type simulator struct {
+	profile *hardware.Profile
+	framed  bool
+	// probability of corrupting a chunk of data sent or received
+	noise   float64
+	inputs  []input
+	knob    int
+	board   *comm.BoardConn
+	status  string
+	leds    map[int]comm.Command
+	pressed map[int]bool
+	mux     sync.Mutex
+}
+
+func newSimulator(profile *hardware.Profile, framed bool, noise float64) *simulator {
+	s := &simulator{profile: profile, framed: framed, noise: noise, knob: -1, leds: make(map[int]comm.Command), pressed: make(map[int]bool)}
+	for i, in := range profile.Inputs {
+		var key byte
+		if i < len(inputKeys) {
+			key = inputKeys[i]
+		}
+		s.inputs = append(s.inputs, input{Input: in, key: key})
+		if in.Kind == hardware.InputKnob && s.knob == -1 {
+			s.knob = in.Index
+		}
+	}
+	return s
+}
+
+func (s *simulator) setStatus(status string) {
+	s.mux.Lock()
+	s.status = status
+	s.mux.Unlock()
+	s.draw()
+}
+
+// serve speaks the board side of the protocol on conn until the host closes
+// it.
+func (s *simulator) serve(conn io.ReadWriter) {
+	var rw io.ReadWriter = conn
+	if s.noise > 0 {
+		rw = &noisyConn{ReadWriter: conn, probability: s.noise}
+	}
+	board := comm.NewBoardConn(rw)
+	s.mux.Lock()
+	s.board = board
+	s.mux.Unlock()
+	for {
+		cmd, err := board.Receive()
+		if err != nil {
+			log.Printf("Receive: %v\n", err)
+			break
+		}
+		s.mux.Lock()
+		if cmd.IsReset() {
+			s.leds = make(map[int]comm.Command)
+			s.pressed = make(map[int]bool)
+		} else {
+			s.leds[cmd.Target()] = cmd
+		}
+		s.mux.Unlock()
+		if cmd.IsReset() {
+			time.Sleep(100 * time.Millisecond)
+			s.send(comm.Message{Message: comm.Hello, Capabilities: capabilities(s.profile, s.framed)})
+			if s.framed {
+				board.EnableFraming()
+			}
+			s.send(comm.Message{Message: comm.Ready})
+		}
+		s.draw()
+	}
+	s.mux.Lock()
+	if s.board == board {
+		s.board = nil
+	}
+	s.mux.Unlock()
+	s.setStatus("disconnected")
+}
+
+func (s *simulator) send(msg comm.Message) {
+	s.mux.Lock()
+	board := s.board
+	s.mux.Unlock()
+	if board == nil {
+		return
+	}
+	if err := board.Send(msg); err != nil {
+		log.Printf("Send: %v\n", err)
+	}
+}
+
+func (s *simulator) toggleButton(in input) {
+	s.mux.Lock()
+	pressed := !s.pressed[in.Index]
+	s.pressed[in.Index] = pressed
+	s.mux.Unlock()
+	if pressed {
+		s.send(comm.Message{Message: comm.ButtonPressed, Source: in.Index})
+	} else {
+		s.send(comm.Message{Message: comm.ButtonReleased, Source: in.Index})
+	}
+	s.draw()
+}
+
+func (s *simulator) tapButton(in input) {
+	s.mux.Lock()
+	wasPressed := s.pressed[in.Index]
+	s.pressed[in.Index] = false
+	s.mux.Unlock()
+	if !wasPressed {
+		s.send(comm.Message{Message: comm.ButtonPressed, Source: in.Index})
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.send(comm.Message{Message: comm.ButtonReleased, Source: in.Index})
+	s.draw()
+}
+
+func (s *simulator) turnKnob(delta int) {
+	if s.knob == -1 {
+		return
+	}
+	s.send(comm.Message{Message: comm.KnobTurned, Source: s.knob, Value: delta})
+}
+
+// runKeyboard handles key presses until the user quits.
+func (s *simulator) runKeyboard(r io.Reader) {
+	reader := bufio.NewReader(r)
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case 3, 4, 'x': // ctrl+c, ctrl+d
+			return
+		case ',', '-':
+			s.turnKnob(-1)
+		case '.', '+':
+			s.turnKnob(1)
+		case '<':
+			s.turnKnob(-5)
+		case '>':
+			s.turnKnob(5)
+		case 0x1b:
+			// arrow keys
+			if seq, err := reader.Peek(2); err == nil && seq[0] == '[' {
+				reader.Discard(2)
+				if seq[1] == 'D' {
+					s.turnKnob(-1)
+				} else if seq[1] == 'C' {
+					s.turnKnob(1)
+				}
+			}
+		default:
+			for _, in := range s.inputs {
+				if in.key == 0 {
+					continue
+				} else if c == in.key {
+					s.toggleButton(in)
+				} else if c == in.key-'a'+'A' {
+					s.tapButton(in)
+				}
+			}
+		}
+	}
+}
+
+// noisyConn randomly corrupts data to simulate a bad connection.
+type noisyConn struct {
+	io.ReadWriter
+	probability float64
+}
+
+func (c *noisyConn) corrupt(p []byte) {
+	if len(p) == 0 || rand.Float64() >= c.probability {
+		return
+	}
+	i := rand.Intn(len(p))
+	if p[i] != '\n' {
+		p[i] ^= 0x20
+	}
+}
+
+func (c *noisyConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.corrupt(p[:n])
+	return n, err
+}
+
+func (c *noisyConn) Write(p []byte) (int, error) {
+	data := append([]byte(nil), p...)
+	c.corrupt(data)
+	return c.ReadWriter.Write(data)
+}
+
+func renderLED(cmd comm.Command) string {
+	if rgb, ok := cmd.RGB(); ok {
+		return fmt.Sprintf("\x1b[38;2;%d;%d;%dm●\x1b[0m", rgb.R, rgb.G, rgb.B)
+	}
+	switch cmd.Color() {
+	case 'R':
+		return "\x1b[1;31m●\x1b[0m"
+	case 'G':
+		return "\x1b[1;32m●\x1b[0m"
+	case 'Y':
+		return "\x1b[1;33m●\x1b[0m"
+	case '1':
+		return "\x1b[1;37m●\x1b[0m"
+	default:
+		return "\x1b[2m○\x1b[0m"
+	}
+}
+
+func (s *simulator) draw() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var b strings.Builder
+	b.WriteString("\x1b[2J\x1b[H")
+	fmt.Fprintf(&b, "rotaryboard simulator - %s\r\n\r\n", s.status)
+	for _, name := range s.profile.ButtonLEDs() {
+		led, _ := s.profile.LED(name)
+		marker := " "
+		if in, ok := s.profile.Input(name); ok && s.pressed[in.Index] {
+			marker = "*"
+		}
+		fmt.Fprintf(&b, "  %s %s%s", renderLED(s.leds[led.Index]), led.Name, marker)
+	}
+	b.WriteString("\r\n\r\n ")
+	for _, name := range s.profile.Bar() {
+		led, _ := s.profile.LED(name)
+		fmt.Fprintf(&b, " %s %s", renderLED(s.leds[led.Index]), led.Name)
+	}
+	b.WriteString("\r\n\r\n")
+	for _, in := range s.inputs {
+		if in.key != 0 {
+			fmt.Fprintf(&b, "  %c/%c: hold/tap %s\r\n", in.key, in.key-'a'+'A', in.Name)
+		}
+	}
+	b.WriteString("  ,/. or arrows: turn knob, </>: turn knob fast\r\n")
+	b.WriteString("  x or ctrl+c: quit\r\n")
+	fmt.Print(b.String())
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package main
+
+// makeTerminalRaw is a no-op on platforms without raw mode support; keys
+// then need to be confirmed with enter.
+func makeTerminalRaw() (func(), error) {
+	return func() {}, nil
+}
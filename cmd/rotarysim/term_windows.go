@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// makeTerminalRaw switches the console to raw mode so single key presses can
+// be read. The returned function restores the previous mode.
+func makeTerminalRaw() (func(), error) {
+	stdin := windows.Handle(os.Stdin.Fd())
+	stdout := windows.Handle(os.Stdout.Fd())
+	var inMode, outMode uint32
+	if err := windows.GetConsoleMode(stdin, &inMode); err != nil {
+		return nil, err
+	}
+	if err := windows.GetConsoleMode(stdout, &outMode); err != nil {
+		return nil, err
+	}
+	rawMode := inMode &^ (windows.ENABLE_ECHO_INPUT | windows.ENABLE_LINE_INPUT | windows.ENABLE_PROCESSED_INPUT)
+	if err := windows.SetConsoleMode(stdin, rawMode|windows.ENABLE_VIRTUAL_TERMINAL_INPUT); err != nil {
+		return nil, err
+	}
+	if err := windows.SetConsoleMode(stdout, outMode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+		windows.SetConsoleMode(stdin, inMode)
+		return nil, err
+	}
+	return func() {
+		windows.SetConsoleMode(stdin, inMode)
+		windows.SetConsoleMode(stdout, outMode)
+	}, nil
+}
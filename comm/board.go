@@ -0,0 +1,109 @@
+package comm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// BoardConn is the board side of the line protocol. It is used to simulate a
+// rotaryboard, e.g. for development on machines without a real board.
+type BoardConn struct {
+	conn   io.ReadWriter
+	reader *bufio.Reader
+	// set once the board uses framed lines
+	framed bool
+	seq    uint16
+	// the sequence numbers of the commands received, to ignore repeated ones
+	rx  frameLink
+	mux sync.Mutex
+}
+
+func NewBoardConn(conn io.ReadWriter) *BoardConn {
+	return &BoardConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// EnableFraming makes the board send framed lines from now on. It should be
+// called after sending a HELLO that announces framing.
+func (b *BoardConn) EnableFraming() {
+	b.mux.Lock()
+	b.framed = true
+	b.mux.Unlock()
+}
+
+func (b *BoardConn) isFramed() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.framed
+}
+
+// Send sends a message to the host.
+func (b *BoardConn) Send(msg Message) error {
+	msgString := serializeMessage(msg)
+	if msgString == "" {
+		return fmt.Errorf("unexpected message: %#v", msg)
+	}
+	return b.write(msgString)
+}
+
+func (b *BoardConn) write(payload string) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.framed {
+		b.seq++
+		payload = encodeFrame(b.seq, payload)
+	}
+	_, err := b.conn.Write([]byte(payload + "\n"))
+	return err
+}
+
+// Receive waits for the next command from the host. Framed commands are
+// acknowledged; corrupted ones are ignored so the host sends them again, and
+// repeated ones are acknowledged again but not returned. An unframed reset is
+// accepted at any time and turns framing off again.
+func (b *BoardConn) Receive() (Command, error) {
+	for {
+		line, err := b.reader.ReadString('\n')
+		if err != nil {
+			return Command{}, err
+		}
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 {
+			continue
+		}
+		if isFrame(trimmed) {
+			seq, payload, err := decodeFrame(trimmed)
+			if err != nil {
+				log.Printf("ignoring corrupted command (%v): %s\n", err, trimmed)
+				continue
+			}
+			if err := b.write(fmt.Sprintf("ACK %d", seq)); err != nil {
+				return Command{}, err
+			}
+			if _, ok := b.rx.received(seq); !ok {
+				log.Printf("ignoring repeated command: %s\n", trimmed)
+				continue
+			}
+			trimmed = payload
+		} else if trimmed == "RST" {
+			// a host which (re)connects always resets the board unframed, and
+			// only switches to framing again after the next handshake
+			b.mux.Lock()
+			b.framed = false
+			b.seq = 0
+			b.mux.Unlock()
+			b.rx = frameLink{}
+		} else if b.isFramed() {
+			log.Printf("ignoring unframed command: %s\n", trimmed)
+			continue
+		}
+		cmd := parseCommand(trimmed)
+		if cmd.command == 0 {
+			return Command{}, fmt.Errorf("unexpected command: %s", trimmed)
+		}
+		return cmd, nil
+	}
+}
@@ -0,0 +1,182 @@
+package comm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Capabilities describe what a board supports. Boards speaking protocol 2 or
+// newer announce them with a HELLO line before READY:
+//
+//	HELLO proto=2 fw=1.4.0 inputs=0,1,2,3 leds=0:RGY,1:1,2:1
+//
+// where each LED lists the color codes it supports; `#` means the LED accepts
+// arbitrary RGB colors. Boards may also announce `framing=crc16` to use
+// framed lines with checksums (see frame.go).
+type Capabilities struct {
+	Protocol int
+	Firmware string
+	Inputs   []int
+	LEDs     map[int]string
+	Framing  bool
+}
+
+// LegacyCapabilities returns the capabilities assumed for boards that only
+// send READY: the knob LED shows red, green and yellow, all other LEDs can
+// only be turned on or off.
+func LegacyCapabilities() *Capabilities {
+	caps := &Capabilities{Protocol: 1, Inputs: []int{0, 1, 2, 3}, LEDs: map[int]string{0: "RGY"}}
+	for i := 1; i <= 8; i++ {
+		caps.LEDs[i] = "1"
+	}
+	return caps
+}
+
+func (c *Capabilities) HasInput(input int) bool {
+	for _, i := range c.Inputs {
+		if i == input {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capabilities) HasLED(led int) bool {
+	_, ok := c.LEDs[led]
+	return ok
+}
+
+// SupportsColor checks whether an LED can show a color code. Turning off an
+// existing LED is always supported.
+func (c *Capabilities) SupportsColor(led int, color byte) bool {
+	colors, ok := c.LEDs[led]
+	if !ok {
+		return false
+	}
+	return color == '0' || strings.IndexByte(colors, color) != -1
+}
+
+// Supports checks whether a command can be executed by the board.
+func (c *Capabilities) Supports(cmd Command) bool {
+	switch cmd.command {
+	case reset:
+		return true
+	case clearLED, setLED:
+		return c.SupportsColor(cmd.target, cmd.Color())
+	case setRGBLED:
+		return c.HasLED(cmd.target)
+	default:
+		return false
+	}
+}
+
+// translate replaces RGB colors the board cannot show with the nearest color
+// code the LED supports.
+func (c *Capabilities) translate(cmd Command) Command {
+	if cmd.command != setRGBLED || c.SupportsColor(cmd.target, '#') {
+		return cmd
+	}
+	color := cmd.rgb.nearestLegacyColor(c.LEDs[cmd.target])
+	if color == '0' {
+		return NewClearLEDCommand(cmd.target)
+	}
+	return NewSetLEDCommand(cmd.target, color)
+}
+
+func (c *Capabilities) String() string {
+	inputs := make([]string, len(c.Inputs))
+	for i, input := range c.Inputs {
+		inputs[i] = strconv.Itoa(input)
+	}
+	var ledIDs []int
+	for led := range c.LEDs {
+		ledIDs = append(ledIDs, led)
+	}
+	sort.Ints(ledIDs)
+	leds := make([]string, len(ledIDs))
+	for i, led := range ledIDs {
+		leds[i] = fmt.Sprintf("%d:%s", led, c.LEDs[led])
+	}
+	s := fmt.Sprintf("HELLO proto=%d fw=%s inputs=%s leds=%s", c.Protocol, c.Firmware, strings.Join(inputs, ","), strings.Join(leds, ","))
+	if c.Framing {
+		s += " framing=" + framingCRC16
+	}
+	return s
+}
+
+func isComma(r rune) bool {
+	return r == ','
+}
+
+func parseCapabilities(s string) (*Capabilities, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || fields[0] != "HELLO" {
+		return nil, fmt.Errorf("not a HELLO line: %s", s)
+	}
+	caps := &Capabilities{LEDs: make(map[int]string)}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid field: %s", field)
+		}
+		switch key {
+		case "proto":
+			protocol, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid protocol version: %s", value)
+			}
+			caps.Protocol = protocol
+		case "fw":
+			caps.Firmware = value
+		case "inputs":
+			for _, item := range strings.FieldsFunc(value, isComma) {
+				input, err := strconv.Atoi(item)
+				if err != nil {
+					return nil, fmt.Errorf("invalid input: %s", item)
+				}
+				caps.Inputs = append(caps.Inputs, input)
+			}
+		case "leds":
+			for _, item := range strings.FieldsFunc(value, isComma) {
+				idString, colors, _ := strings.Cut(item, ":")
+				led, err := strconv.Atoi(idString)
+				if err != nil {
+					return nil, fmt.Errorf("invalid led: %s", item)
+				}
+				caps.LEDs[led] = colors
+			}
+		case "framing":
+			if value != framingCRC16 {
+				return nil, fmt.Errorf("unsupported framing: %s", value)
+			}
+			caps.Framing = true
+		default:
+			// ignore unknown keys so newer firmware can announce more
+		}
+	}
+	if caps.Protocol < 2 {
+		return nil, fmt.Errorf("invalid protocol version: %d", caps.Protocol)
+	}
+	return caps, nil
+}
+
+// handshake attaches the capabilities announced by the board to its READY
+// message.
+type handshake struct {
+	caps *Capabilities
+}
+
+func (h *handshake) handle(msg *Message) {
+	switch msg.Message {
+	case Hello:
+		h.caps = msg.Capabilities
+	case Ready:
+		if h.caps == nil {
+			h.caps = LegacyCapabilities()
+		}
+		msg.Capabilities = h.caps
+		h.caps = nil
+	}
+}
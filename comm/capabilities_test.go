@@ -0,0 +1,108 @@
+package comm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	tests := []struct {
+		line string
+		want *Capabilities
+	}{
+		{
+			"HELLO proto=2 fw=1.4.0 inputs=0,1,2,3 leds=0:RGY,1:1,2:1",
+			&Capabilities{Protocol: 2, Firmware: "1.4.0", Inputs: []int{0, 1, 2, 3}, LEDs: map[int]string{0: "RGY", 1: "1", 2: "1"}},
+		},
+		{
+			"HELLO proto=3 fw=2.0 inputs=0 leds=0:RGY#,4:1 framing=crc16",
+			&Capabilities{Protocol: 3, Firmware: "2.0", Inputs: []int{0}, LEDs: map[int]string{0: "RGY#", 4: "1"}, Framing: true},
+		},
+		// unknown keys are ignored so newer firmware can announce more
+		{
+			"HELLO proto=2 fw=1.0 inputs= leds= sensors=3",
+			&Capabilities{Protocol: 2, Firmware: "1.0", LEDs: map[int]string{}},
+		},
+		{"READY", nil},
+		{"HELLO fw=1.0", nil},
+		{"HELLO proto=1", nil},
+		{"HELLO proto=two", nil},
+		{"HELLO proto=2 inputs=0,x", nil},
+		{"HELLO proto=2 leds=x:RGY", nil},
+		{"HELLO proto=2 framing=crc32", nil},
+		{"HELLO proto=2 broken", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseCapabilities(tt.line)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", tt.line, got)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, %v, want %+v", tt.line, got, err, tt.want)
+		}
+	}
+}
+
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	caps := &Capabilities{Protocol: 2, Firmware: "1.4.0", Inputs: []int{0, 3}, LEDs: map[int]string{7: "1", 0: "RGY#"}, Framing: true}
+	line := caps.String()
+	if want := "HELLO proto=2 fw=1.4.0 inputs=0,3 leds=0:RGY#,7:1 framing=crc16"; line != want {
+		t.Errorf("got %s, want %s", line, want)
+	}
+	got, err := parseCapabilities(line)
+	if err != nil || !reflect.DeepEqual(got, caps) {
+		t.Errorf("got %+v, %v, want %+v", got, err, caps)
+	}
+}
+
+func TestCapabilitiesSupports(t *testing.T) {
+	caps := &Capabilities{Protocol: 2, LEDs: map[int]string{0: "RGY", 1: "1", 2: "#"}}
+	tests := []struct {
+		cmd  Command
+		want bool
+	}{
+		{NewResetCommand(), true},
+		{NewSetLEDCommand(0, 'G'), true},
+		{NewSetLEDCommand(1, 'G'), false},
+		{NewSetLEDCommand(1, '1'), true},
+		{NewClearLEDCommand(1), true},
+		{NewClearLEDCommand(5), false},
+		{NewSetRGBLEDCommand(2, RGB{1, 2, 3}), true},
+		// translated to a color code for LEDs without RGB
+		{NewSetRGBLEDCommand(0, RGB{1, 2, 3}), true},
+		{NewSetRGBLEDCommand(5, RGB{1, 2, 3}), false},
+	}
+	for _, tt := range tests {
+		if got := caps.Supports(tt.cmd); got != tt.want {
+			t.Errorf("%s: got %v, want %v", serializeCommand(tt.cmd), got, tt.want)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	caps := &Capabilities{Protocol: 2, LEDs: map[int]string{0: "RGY#"}}
+	var h handshake
+	// boards speaking protocol 1 only send READY
+	ready := Message{Message: Ready}
+	h.handle(&ready)
+	if !reflect.DeepEqual(ready.Capabilities, LegacyCapabilities()) {
+		t.Errorf("got %+v, want the legacy capabilities", ready.Capabilities)
+	}
+
+	hello := Message{Message: Hello, Capabilities: caps}
+	h.handle(&hello)
+	ready = Message{Message: Ready}
+	h.handle(&ready)
+	if ready.Capabilities != caps {
+		t.Errorf("got %+v, want the announced capabilities", ready.Capabilities)
+	}
+
+	// a board reconnecting without HELLO, e.g. after a firmware downgrade,
+	// does not keep the capabilities
+	ready = Message{Message: Ready}
+	h.handle(&ready)
+	if !reflect.DeepEqual(ready.Capabilities, LegacyCapabilities()) {
+		t.Errorf("got %+v after reconnecting, want the legacy capabilities", ready.Capabilities)
+	}
+}
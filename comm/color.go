@@ -0,0 +1,73 @@
+package comm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RGB is an arbitrary LED color. Boards that announce `#` as a supported
+// color of an LED get it as `RLED.<n>=#rrggbb`; for all other boards it is
+// replaced by the nearest color code the LED supports.
+type RGB struct {
+	R, G, B uint8
+}
+
+// colors the legacy color codes correspond to
+var legacyColors = map[byte]RGB{
+	'R': {255, 0, 0},
+	'G': {0, 255, 0},
+	'Y': {255, 255, 0},
+	'1': {255, 255, 255},
+}
+
+// ParseRGB parses a hex color such as `#ff8800`.
+func ParseRGB(s string) (RGB, error) {
+	var c RGB
+	if _, err := fmt.Sscanf(strings.TrimPrefix(s, "#"), "%02x%02x%02x", &c.R, &c.G, &c.B); err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return RGB{}, fmt.Errorf("invalid color: %s", s)
+	}
+	return c, nil
+}
+
+// Scale returns the color with its brightness multiplied by f.
+func (c RGB) Scale(f float64) RGB {
+	return RGB{uint8(float64(c.R) * f), uint8(float64(c.G) * f), uint8(float64(c.B) * f)}
+}
+
+// LegacyColor returns the RGB equivalent of a color code.
+func LegacyColor(code byte) (RGB, bool) {
+	c, ok := legacyColors[code]
+	return c, ok
+}
+
+func (c RGB) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (c RGB) distance(other RGB) int {
+	dr := int(c.R) - int(other.R)
+	dg := int(c.G) - int(other.G)
+	db := int(c.B) - int(other.B)
+	return dr*dr + dg*dg + db*db
+}
+
+// nearestLegacyColor returns the supported color code closest to the color,
+// or '0' if the color is (almost) black.
+func (c RGB) nearestLegacyColor(supported string) byte {
+	if max(c.R, c.G, c.B) < 32 {
+		return '0'
+	}
+	best := byte('0')
+	bestDistance := -1
+	for i := 0; i < len(supported); i++ {
+		legacy, ok := legacyColors[supported[i]]
+		if !ok {
+			continue
+		}
+		if d := c.distance(legacy); bestDistance == -1 || d < bestDistance {
+			best = supported[i]
+			bestDistance = d
+		}
+	}
+	return best
+}
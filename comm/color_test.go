@@ -0,0 +1,72 @@
+package comm
+
+import "testing"
+
+func TestParseRGB(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    RGB
+		wantErr bool
+	}{
+		{s: "#ff8000", want: RGB{255, 128, 0}},
+		{s: "00FF7f", want: RGB{0, 255, 127}},
+		{s: "#000000"},
+		{s: "#ff80", wantErr: true},
+		{s: "#ff800000", wantErr: true},
+		{s: "#gg0000", wantErr: true},
+		{s: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRGB(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%q: got %v, %v, want %v, an error: %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil && tt.s[0] == '#' && got.String() != tt.s {
+			t.Errorf("%q: got %s back", tt.s, got)
+		}
+	}
+}
+
+func TestNearestLegacyColor(t *testing.T) {
+	tests := []struct {
+		name      string
+		color     RGB
+		supported string
+		want      byte
+	}{
+		{"exact match", RGB{255, 0, 0}, "RGY", 'R'},
+		{"orange is closer to yellow", RGB{255, 160, 0}, "RGY", 'Y'},
+		{"dark green", RGB{0, 100, 0}, "RGY", 'G'},
+		{"white on an rgy led", RGB{255, 255, 255}, "RGY", 'Y'},
+		{"any color on an on/off led", RGB{0, 0, 255}, "1", '1'},
+		{"nearly black", RGB{20, 31, 0}, "RGY", '0'},
+		{"unknown color codes are skipped", RGB{0, 255, 0}, "#XG", 'G'},
+		{"no supported color codes", RGB{0, 255, 0}, "#", '0'},
+	}
+	for _, tt := range tests {
+		if got := tt.color.nearestLegacyColor(tt.supported); got != tt.want {
+			t.Errorf("%s: got %c, want %c", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	caps := &Capabilities{Protocol: 2, LEDs: map[int]string{0: "RGY", 1: "1", 2: "RGY#"}}
+	tests := []struct {
+		cmd  Command
+		want Command
+	}{
+		{NewSetRGBLEDCommand(0, RGB{250, 10, 10}), NewSetLEDCommand(0, 'R')},
+		{NewSetRGBLEDCommand(1, RGB{0, 0, 200}), NewSetLEDCommand(1, '1')},
+		// too dark to be shown without rgb
+		{NewSetRGBLEDCommand(1, RGB{10, 10, 10}), NewClearLEDCommand(1)},
+		// leds supporting rgb get the color itself
+		{NewSetRGBLEDCommand(2, RGB{250, 10, 10}), NewSetRGBLEDCommand(2, RGB{250, 10, 10})},
+		{NewSetLEDCommand(0, 'G'), NewSetLEDCommand(0, 'G')},
+	}
+	for _, tt := range tests {
+		if got := caps.translate(tt.cmd); got != tt.want {
+			t.Errorf("%s: got %s, want %s", serializeCommand(tt.cmd), serializeCommand(got), serializeCommand(tt.want))
+		}
+	}
+}
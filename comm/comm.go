@@ -2,17 +2,27 @@ package comm
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strings"
-
-	"github.com/tarm/serial"
+	"sync"
+	"time"
 )
 
 func parseMessage(s string) Message {
 	var id, value int
 	if s == "READY" {
 		return Message{Message: Ready}
+	} else if strings.HasPrefix(s, "HELLO ") {
+		caps, err := parseCapabilities(s)
+		if err != nil {
+			log.Printf("invalid handshake: %v\n", err)
+			return Message{Message: invalid}
+		}
+		return Message{Message: Hello, Capabilities: caps}
 	} else if _, err := fmt.Sscanf(s, "RBTN.%d=1", &id); err == nil {
 		return Message{Message: ButtonPressed, Source: id}
 	} else if _, err := fmt.Sscanf(s, "RBTN.%d=0", &id); err == nil {
@@ -23,6 +33,39 @@ func parseMessage(s string) Message {
 	return Message{Message: invalid}
 }
 
+func parseCommand(s string) Command {
+	var id int
+	var color byte
+	var rgb RGB
+	if s == "RST" {
+		return NewResetCommand()
+	} else if _, err := fmt.Sscanf(s, "RLED.%d=#%02x%02x%02x", &id, &rgb.R, &rgb.G, &rgb.B); err == nil {
+		return NewSetRGBLEDCommand(id, rgb)
+	} else if _, err := fmt.Sscanf(s, "RLED.%d=0", &id); err == nil {
+		return NewClearLEDCommand(id)
+	} else if _, err := fmt.Sscanf(s, "RLED.%d=%c", &id, &color); err == nil {
+		return NewSetLEDCommand(id, color)
+	}
+	return Command{}
+}
+
+func serializeMessage(msg Message) string {
+	switch msg.Message {
+	case Ready:
+		return "READY"
+	case Hello:
+		return msg.Capabilities.String()
+	case ButtonPressed:
+		return fmt.Sprintf("RBTN.%d=1", msg.Source)
+	case ButtonReleased:
+		return fmt.Sprintf("RBTN.%d=0", msg.Source)
+	case KnobTurned:
+		return fmt.Sprintf("RVAL.%d=%d", msg.Source, msg.Value)
+	default:
+		return ""
+	}
+}
+
 func serializeCommand(cmd Command) string {
 	switch cmd.command {
 	case reset:
@@ -31,57 +74,338 @@ func serializeCommand(cmd Command) string {
 		return fmt.Sprintf("RLED.%d=0", cmd.target)
 	case setLED:
 		return fmt.Sprintf("RLED.%d=%c", cmd.target, cmd.color)
+	case setRGBLED:
+		return fmt.Sprintf("RLED.%d=%s", cmd.target, cmd.rgb)
 	default:
 		return ""
 	}
 }
 
-func serialWorker(port string, msgChan chan<- Message, cmdChan <-chan Command) {
-	log.Printf("opening serial port %s\n", port)
-	conn, err := serial.OpenPort(&serial.Config{Name: port, Baud: 19200})
-	if err != nil {
-		log.Fatalf("OpenPort: %v\n", err)
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 10 * time.Second
+	readyTimeout      = 5 * time.Second
+	frameInterval     = 20 * time.Millisecond
+	statsInterval     = 1 * time.Minute
+)
+
+type serialWorker struct {
+	ctx       context.Context
+	transport Transport
+	msgChan   chan<- Message
+	conn      io.ReadWriteCloser
+	ready     bool
+	caps      *Capabilities
+	frame     *frameBuffer
+	// link is set while the board uses framed lines
+	link *frameLink
+	mux  sync.Mutex
+}
+
+// run keeps the board connected, reopening the port with backoff whenever it
+// goes away, until the context is cancelled.
+func (w *serialWorker) run() {
+	defer close(w.msgChan)
+	delay := minReconnectDelay
+	waiting := false
+	for w.ctx.Err() == nil {
+		if !waiting {
+			log.Printf("opening %s\n", w.transport)
+		}
+		conn, err := w.transport.Open()
+		if errors.Is(err, ErrDeviceNotPresent) {
+			// poll until the device is plugged in
+			if !waiting {
+				log.Printf("waiting for %s to be plugged in\n", w.transport)
+				waiting = true
+			}
+			w.sleep(usbPollInterval)
+			continue
+		}
+		waiting = false
+		if err != nil {
+			log.Printf("could not open %s: %v (retrying in %v)\n", w.transport, err, delay)
+			w.sleep(delay)
+			delay = min(delay*2, maxReconnectDelay)
+			continue
+		}
+		delay = minReconnectDelay
+		w.mux.Lock()
+		if w.ctx.Err() != nil {
+			// the writer has already shut down
+			w.mux.Unlock()
+			conn.Close()
+			return
+		}
+		w.conn = conn
+		w.ready = false
+		w.mux.Unlock()
+		w.msgChan <- Message{Message: Connected}
+
+		log.Println("resetting rotaryboard")
+		if _, err := conn.Write([]byte(serializeCommand(NewResetCommand()) + "\n")); err != nil {
+			log.Printf("Write: %v\n", err)
+		} else {
+			w.readLoop(conn)
+		}
+
+		w.mux.Lock()
+		conn.Close()
+		w.conn = nil
+		w.ready = false
+		w.link = nil
+		w.mux.Unlock()
+		if w.ctx.Err() != nil {
+			log.Printf("closed %s\n", w.transport)
+			return
+		}
+		log.Printf("lost connection to %s\n", w.transport)
+		w.msgChan <- Message{Message: Disconnected}
+	}
+}
+
+// sleep waits for d or until the context is cancelled.
+func (w *serialWorker) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-w.ctx.Done():
 	}
+}
 
+func (w *serialWorker) readLoop(conn io.ReadWriteCloser) {
+	readyTimer := time.AfterFunc(readyTimeout, func() {
+		log.Println("rotaryboard did not become ready")
+		conn.Close()
+	})
+	defer readyTimer.Stop()
+
+	var hs handshake
 	reader := bufio.NewReader(conn)
-	go func() {
-		for {
-			line, isPrefix, err := reader.ReadLine()
-			if err != nil {
-				log.Fatalf("ReadLine: %v\n", err)
+	// set while skipping the rest of a line that is too long
+	skipping := false
+	for {
+		line, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			if w.ctx.Err() == nil {
+				log.Printf("ReadLine: %v\n", err)
 			}
-			if isPrefix {
-				log.Fatalf("got incomplete line: %s\n", string(line))
+			return
+		}
+		if skipping || isPrefix {
+			if !skipping {
+				log.Printf("ignoring overlong line: %s...\n", string(line))
 			}
-			trimmed := strings.TrimSpace(string(line))
-			if len(trimmed) > 0 {
-				msg := parseMessage(trimmed)
-				if msg.Message == invalid {
-					log.Fatalf("unexpected message: %s\n", trimmed)
-				}
-				msgChan <- msg
+			skipping = isPrefix
+			continue
+		}
+		trimmed := strings.TrimSpace(string(line))
+		if len(trimmed) == 0 {
+			continue
+		}
+		payload, ok := w.unframe(trimmed)
+		if !ok {
+			continue
+		}
+		msg := parseMessage(payload)
+		if msg.Message == invalid {
+			log.Printf("ignoring unexpected message: %s\n", trimmed)
+			continue
+		}
+		hs.handle(&msg)
+		if msg.Message == Ready {
+			readyTimer.Stop()
+			log.Printf("rotaryboard ready: protocol %d, firmware %q\n", msg.Capabilities.Protocol, msg.Capabilities.Firmware)
+			w.mux.Lock()
+			w.ready = true
+			w.caps = msg.Capabilities
+			w.link = nil
+			if msg.Capabilities.Framing {
+				log.Println("using framed lines")
+				w.link = newFrameLink()
 			}
+			// the reset cleared all LEDs on the board
+			w.frame.invalidate()
+			w.mux.Unlock()
 		}
-	}()
+		w.msgChan <- msg
+	}
+}
 
+// unframe checks an incoming line and returns its payload. Corrupted frames
+// and acknowledgements are handled here and return false.
+func (w *serialWorker) unframe(line string) (string, bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if !isFrame(line) {
+		if w.link != nil {
+			log.Printf("ignoring unframed line: %s\n", line)
+			return "", false
+		}
+		return line, true
+	}
+	seq, payload, err := decodeFrame(line)
+	if err != nil {
+		log.Printf("ignoring corrupted line (%v): %s\n", err, line)
+		w.frame.stats.corrupted++
+		return "", false
+	}
+	if w.link != nil {
+		lost, ok := w.link.received(seq)
+		if !ok {
+			log.Printf("ignoring repeated line: %s\n", line)
+			return "", false
+		}
+		if lost > 0 {
+			log.Printf("lost %d messages from the board\n", lost)
+		}
+	}
+	if ackSeq, ok := parseAck(payload); ok {
+		if w.link != nil {
+			w.link.ack(ackSeq)
+		}
+		return "", false
+	}
+	return payload, true
+}
+
+// queue updates the frame buffer with an LED command. Resets are sent to the
+// board right away and invalid commands are dropped.
+func (w *serialWorker) queue(cmd Command) {
+	if serializeCommand(cmd) == "" {
+		log.Printf("dropping unexpected command: %#v\n", cmd)
+		return
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if cmd.command != reset {
+		w.frame.set(cmd)
+		return
+	}
+	w.frame.clear()
+	if w.conn != nil && w.ready {
+		w.send(w.line(cmd) + "\n")
+	}
+}
+
+// flush sends all LEDs that changed since the last flush in a single write.
+// While the board is disconnected or not ready yet nothing is sent; the frame
+// buffer then catches up once the board reports READY again.
+func (w *serialWorker) flush() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.conn == nil || !w.ready {
+		return
+	}
+	var batch strings.Builder
+	if w.link != nil {
+		lines, err := w.link.expired(time.Now())
+		if err != nil {
+			log.Printf("%v, reconnecting\n", err)
+			// the board gets reset and all LEDs are sent again
+			w.conn.Close()
+			w.ready = false
+			return
+		}
+		for _, line := range lines {
+			batch.WriteString(line + "\n")
+			w.frame.stats.retransmits++
+		}
+	}
+	for _, cmd := range w.frame.changes() {
+		if !w.caps.Supports(cmd) {
+			log.Printf("refusing command not supported by the board: %s\n", serializeCommand(cmd))
+			w.frame.markDropped(cmd)
+			continue
+		}
+		batch.WriteString(w.line(w.caps.translate(cmd)) + "\n")
+		w.frame.markSent(cmd)
+	}
+	if batch.Len() > 0 {
+		w.send(batch.String())
+	}
+}
+
+// line serializes a command, framing it if the board uses framed lines. Must
+// be called with the mutex held.
+func (w *serialWorker) line(cmd Command) string {
+	if w.link != nil {
+		return w.link.frame(cmd)
+	}
+	return serializeCommand(cmd)
+}
+
+func (w *serialWorker) send(data string) {
+	if _, err := w.conn.Write([]byte(data)); err != nil {
+		log.Printf("Write: %v\n", err)
+		// closing the connection makes the reader fail and reconnect
+		w.conn.Close()
+	}
+}
+
+// shutdown resets the board so no LEDs stay lit and closes the connection,
+// which makes the reader stop.
+func (w *serialWorker) shutdown(cmdChan <-chan Command) {
+	// commands that are still queued are pointless since the board is reset
+	// anyway, but they must not block anyone sending them
 	go func() {
-		for cmd := range cmdChan {
-			cmdString := serializeCommand(cmd)
-			if cmdString == "" {
-				log.Fatalf("unexpected command: %#v\n", cmd)
+		for range cmdChan {
+		}
+	}()
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.conn == nil {
+		return
+	}
+	if w.ready {
+		log.Println("resetting rotaryboard")
+		w.send(w.line(NewResetCommand()) + "\n")
+	}
+	w.conn.Close()
+}
+
+func (w *serialWorker) writeLoop(cmdChan <-chan Command) {
+	flushTicker := time.NewTicker(frameInterval)
+	defer flushTicker.Stop()
+	statsTicker := time.NewTicker(statsInterval)
+	defer statsTicker.Stop()
+	var lastStats frameStats
+	for {
+		select {
+		case <-w.ctx.Done():
+			w.shutdown(cmdChan)
+			return
+		case cmd, ok := <-cmdChan:
+			if !ok {
+				return
 			}
-			if _, err := conn.Write([]byte(cmdString + "\n")); err != nil {
-				log.Fatalf("Write: %v\n", err)
+			w.queue(cmd)
+		case <-flushTicker.C:
+			w.mux.Lock()
+			w.frame.stats.maxBacklog = max(w.frame.stats.maxBacklog, len(cmdChan))
+			w.mux.Unlock()
+			w.flush()
+		case <-statsTicker.C:
+			w.mux.Lock()
+			stats := w.frame.stats
+			w.mux.Unlock()
+			if stats != lastStats {
+				log.Printf("led frame buffer: %s\n", stats)
+				lastStats = stats
 			}
 		}
-	}()
+	}
 }
 
-func OpenPort(port string) (<-chan Message, chan<- Command) {
+// OpenPort keeps a connection to the board on transport until ctx is
+// cancelled. The board is then reset and the message channel is closed once
+// the connection has been closed.
+func OpenPort(ctx context.Context, transport Transport) (<-chan Message, chan<- Command) {
 	msgChan := make(chan Message, 8)
 	cmdChan := make(chan Command, 8)
-	serialWorker(port, msgChan, cmdChan)
-	log.Println("resetting rotaryboard")
-	cmdChan <- NewResetCommand()
+	w := &serialWorker{ctx: ctx, transport: transport, msgChan: msgChan, frame: newFrameBuffer()}
+	go w.run()
+	go w.writeLoop(cmdChan)
 	return msgChan, cmdChan
 }
@@ -12,6 +12,10 @@ func NewSetLEDCommand(target int, color byte) Command {
 	return Command{command: setLED, target: target, color: color}
 }
 
+func NewSetRGBLEDCommand(target int, color RGB) Command {
+	return Command{command: setRGBLED, target: target, color: '#', rgb: color}
+}
+
 func NewToggleLEDCommand(target int, on bool) Command {
 	if on {
 		return NewSetLEDCommand(target, '1');
@@ -19,3 +23,37 @@ func NewToggleLEDCommand(target int, on bool) Command {
 		return NewClearLEDCommand(target);
 	}
 }
+
+func (c Command) IsReset() bool {
+	return c.command == reset
+}
+
+// Target returns the LED a command refers to.
+func (c Command) Target() int {
+	return c.target
+}
+
+// WithTarget returns the same command for a different LED.
+func (c Command) WithTarget(target int) Command {
+	c.target = target
+	return c
+}
+
+// Color returns the color code a command sets; cleared LEDs have color '0'
+// and RGB colors '#'.
+func (c Command) Color() byte {
+	if c.command == clearLED {
+		return '0'
+	}
+	return c.color
+}
+
+// RGB returns the color of a command setting an RGB color.
+func (c Command) RGB() (RGB, bool) {
+	return c.rgb, c.command == setRGBLED
+}
+
+// sameLED checks whether two commands result in the same LED state.
+func (c Command) sameLED(other Command) bool {
+	return c.command != 0 && c.Color() == other.Color() && c.rgb == other.rgb
+}
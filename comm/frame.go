@@ -0,0 +1,160 @@
+package comm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Boards announcing `framing=crc16` in their HELLO line use framed lines for
+// everything after the handshake:
+//
+//	$<seq>,<payload>*<crc>
+//
+// seq is a decimal sequence number counted separately in each direction and
+// crc is the CRC-16/CCITT of `<seq>,<payload>` as four hex digits. The board
+// acknowledges every command it received intact with an `ACK <seq>` frame;
+// commands that are not acknowledged in time are sent again.
+const framingCRC16 = "crc16"
+
+const (
+	ackTimeout = 250 * time.Millisecond
+	// after this many attempts the connection is considered broken
+	maxSendAttempts = 5
+)
+
+func crc16(data string) uint16 {
+	crc := uint16(0xffff)
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func encodeFrame(seq uint16, payload string) string {
+	body := fmt.Sprintf("%d,%s", seq, payload)
+	return fmt.Sprintf("$%s*%04X", body, crc16(body))
+}
+
+func isFrame(line string) bool {
+	return strings.HasPrefix(line, "$")
+}
+
+func decodeFrame(line string) (uint16, string, error) {
+	body, checksum, ok := strings.Cut(strings.TrimPrefix(line, "$"), "*")
+	if !ok || len(checksum) != 4 {
+		return 0, "", errors.New("no checksum")
+	}
+	crc, err := strconv.ParseUint(checksum, 16, 16)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid checksum: %s", checksum)
+	}
+	if uint16(crc) != crc16(body) {
+		return 0, "", fmt.Errorf("checksum mismatch: %s", checksum)
+	}
+	seqString, payload, ok := strings.Cut(body, ",")
+	if !ok {
+		return 0, "", errors.New("no sequence number")
+	}
+	seq, err := strconv.ParseUint(seqString, 10, 16)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid sequence number: %s", seqString)
+	}
+	return uint16(seq), payload, nil
+}
+
+func parseAck(payload string) (uint16, bool) {
+	var seq uint16
+	if _, err := fmt.Sscanf(payload, "ACK %d", &seq); err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+type pendingFrame struct {
+	cmd      Command
+	line     string
+	sentAt   time.Time
+	attempts int
+}
+
+// frameLink keeps track of the sequence numbers of a framed connection and the
+// commands that have not been acknowledged yet.
+type frameLink struct {
+	txSeq   uint16
+	rxSeq   uint16
+	rxValid bool
+	pending map[uint16]*pendingFrame
+	// the sequence number of the last command sent for each LED
+	latest map[int]uint16
+}
+
+func newFrameLink() *frameLink {
+	return &frameLink{pending: make(map[uint16]*pendingFrame), latest: make(map[int]uint16)}
+}
+
+// frame wraps a command in a frame and remembers it until it is acknowledged.
+func (l *frameLink) frame(cmd Command) string {
+	l.txSeq++
+	line := encodeFrame(l.txSeq, serializeCommand(cmd))
+	if cmd.command != reset {
+		l.pending[l.txSeq] = &pendingFrame{cmd: cmd, line: line, sentAt: time.Now(), attempts: 1}
+		l.latest[cmd.target] = l.txSeq
+	}
+	return line
+}
+
+func (l *frameLink) ack(seq uint16) {
+	delete(l.pending, seq)
+}
+
+// received checks the sequence number of an incoming frame and returns how
+// many frames have been lost before it. It returns false for frames that have
+// been received before, e.g. commands sent again because their ACK got lost.
+func (l *frameLink) received(seq uint16) (int, bool) {
+	lost := 0
+	if l.rxValid {
+		// sequence numbers wrap around
+		diff := int16(seq - l.rxSeq)
+		if diff <= 0 {
+			return 0, false
+		}
+		lost = int(diff) - 1
+	}
+	l.rxSeq = seq
+	l.rxValid = true
+	return lost, true
+}
+
+// expired returns the lines that have to be sent again because they were not
+// acknowledged in time. Commands for LEDs that got a newer command since then
+// are not repeated since they would undo the newer one. If a command has been
+// sent too often without being acknowledged an error is returned.
+func (l *frameLink) expired(now time.Time) ([]string, error) {
+	var lines []string
+	for seq, frame := range l.pending {
+		if now.Sub(frame.sentAt) < ackTimeout {
+			continue
+		}
+		if l.latest[frame.cmd.target] != seq {
+			delete(l.pending, seq)
+			continue
+		}
+		if frame.attempts >= maxSendAttempts {
+			return nil, fmt.Errorf("command %d not acknowledged after %d attempts", seq, frame.attempts)
+		}
+		frame.attempts++
+		frame.sentAt = now
+		lines = append(lines, frame.line)
+	}
+	return lines, nil
+}
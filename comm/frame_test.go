@@ -0,0 +1,313 @@
+package comm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	// the check value of CRC-16/CCITT-FALSE
+	if crc := crc16("123456789"); crc != 0x29B1 {
+		t.Errorf("got %04X, want 29B1", crc)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		seq     uint16
+		payload string
+	}{
+		{1, "RLED.2=1"},
+		{42, "RLED.0=#ff8000"},
+		{65535, "ACK 7"},
+		{7, "HELLO proto=2 fw=1.0 framing=crc16"},
+		{3, ""},
+	}
+	for _, tt := range tests {
+		line := encodeFrame(tt.seq, tt.payload)
+		if !isFrame(line) {
+			t.Errorf("%s is not a frame", line)
+		}
+		seq, payload, err := decodeFrame(line)
+		if err != nil || seq != tt.seq || payload != tt.payload {
+			t.Errorf("%s: got %d, %q, %v, want %d, %q", line, seq, payload, err, tt.seq, tt.payload)
+		}
+	}
+}
+
+func TestDecodeFrameErrors(t *testing.T) {
+	valid := encodeFrame(5, "RBTN.1=1")
+	body, checksum, _ := strings.Cut(valid, "*")
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"corrupted payload", strings.Replace(valid, "RBTN.1", "RBTN.2", 1)},
+		{"corrupted checksum", body + "*0000"},
+		{"invalid checksum", body + "*XYZW"},
+		{"short checksum", body + "*" + checksum[:3]},
+		{"no checksum", body},
+		{"no sequence number", fmt.Sprintf("$RBTN.1=1*%04X", crc16("RBTN.1=1"))},
+		{"invalid sequence number", fmt.Sprintf("$x,RBTN.1=1*%04X", crc16("x,RBTN.1=1"))},
+	}
+	for _, tt := range tests {
+		if _, _, err := decodeFrame(tt.line); err == nil {
+			t.Errorf("%s: %s decoded without an error", tt.name, tt.line)
+		}
+	}
+}
+
+func TestFrameLinkReceived(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint16
+		// the result for the last sequence number
+		lost int
+		ok   bool
+	}{
+		{name: "first frame", seqs: []uint16{7}, ok: true},
+		{name: "next frame", seqs: []uint16{1, 2}, ok: true},
+		{name: "lost frames", seqs: []uint16{1, 4}, lost: 2, ok: true},
+		{name: "duplicate", seqs: []uint16{1, 2, 2}},
+		{name: "older frame", seqs: []uint16{1, 5, 3}},
+		{name: "wrapping around", seqs: []uint16{65535, 0}, ok: true},
+		{name: "lost frames while wrapping around", seqs: []uint16{65534, 1}, lost: 2, ok: true},
+	}
+	for _, tt := range tests {
+		var l frameLink
+		var lost int
+		var ok bool
+		for _, seq := range tt.seqs {
+			lost, ok = l.received(seq)
+		}
+		if lost != tt.lost || ok != tt.ok {
+			t.Errorf("%s: got %d, %v, want %d, %v", tt.name, lost, ok, tt.lost, tt.ok)
+		}
+	}
+}
+
+func TestFrameLinkExpired(t *testing.T) {
+	l := newFrameLink()
+	first := l.frame(NewSetLEDCommand(2, '1'))
+	l.frame(NewSetLEDCommand(3, '1'))
+	// a newer command for the LED replaces the unacknowledged one
+	l.frame(NewSetLEDCommand(3, '0'))
+	acked := l.frame(NewSetLEDCommand(4, '1'))
+	seq, _, _ := decodeFrame(acked)
+	l.ack(seq)
+	// resets are not acknowledged
+	l.frame(NewResetCommand())
+	start := time.Now()
+
+	if lines, err := l.expired(start); err != nil || len(lines) != 0 {
+		t.Fatalf("got %v, %v before the timeout", lines, err)
+	}
+	lines, err := l.expired(start.Add(ackTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || !containsLine(lines, first) {
+		t.Fatalf("got %v, want the commands for LEDs 2 and 3 sent again", lines)
+	}
+	// the connection is broken once a command has been sent too often
+	now := start.Add(ackTimeout)
+	for attempt := 2; attempt < maxSendAttempts; attempt++ {
+		now = now.Add(ackTimeout)
+		if _, err := l.expired(now); err != nil {
+			t.Fatalf("attempt %d: %v", attempt+1, err)
+		}
+	}
+	if _, err := l.expired(now.Add(ackTimeout)); err == nil {
+		t.Fatal("no error after the last attempt")
+	}
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// rawBoard is the board side of a pipe which sends and reads lines as they
+// are, so tests can corrupt, repeat and drop them.
+type rawBoard struct {
+	t     *testing.T
+	conn  net.Conn
+	lines chan string
+	seq   uint16
+}
+
+func newRawBoard(t *testing.T, conn io.ReadWriteCloser) *rawBoard {
+	b := &rawBoard{t: t, conn: conn.(net.Conn), lines: make(chan string, 16)}
+	go func() {
+		defer close(b.lines)
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			b.lines <- strings.TrimSpace(line)
+		}
+	}()
+	return b
+}
+
+func (b *rawBoard) write(line string) {
+	b.t.Helper()
+	if _, err := b.conn.Write([]byte(line + "\n")); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// frame returns the next frame sent by the board.
+func (b *rawBoard) frame(payload string) string {
+	b.seq++
+	return encodeFrame(b.seq, payload)
+}
+
+func (b *rawBoard) readLine(timeout time.Duration) (string, bool) {
+	select {
+	case line, ok := <-b.lines:
+		return line, ok
+	case <-time.After(timeout):
+		return "", false
+	}
+}
+
+// readFrame waits for the next framed line from the host.
+func (b *rawBoard) readFrame() (string, uint16, string) {
+	b.t.Helper()
+	line, ok := b.readLine(5 * time.Second)
+	if !ok {
+		b.t.Fatal("no line received")
+	}
+	seq, payload, err := decodeFrame(line)
+	if err != nil {
+		b.t.Fatalf("%s: %v", line, err)
+	}
+	return line, seq, payload
+}
+
+// TestFramedPipe runs a board using framed lines on a pipe and checks that
+// the host sends commands again until they are acknowledged and ignores
+// corrupted and repeated lines.
+func TestFramedPipe(t *testing.T) {
+	pipe := NewPipeTransport("framed")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgChan, cmdChan := OpenPort(ctx, pipe)
+
+	var conn io.ReadWriteCloser
+	select {
+	case conn = <-pipe.Boards:
+	case <-time.After(5 * time.Second):
+		t.Fatal("host did not connect")
+	}
+	board := newRawBoard(t, conn)
+	if msg := receiveMessage(t, msgChan); msg.Message != Connected {
+		t.Fatalf("got %+v, want connected", msg)
+	}
+	if line, _ := board.readLine(5 * time.Second); line != "RST" {
+		t.Fatalf("got %q, want an unframed reset", line)
+	}
+	caps := LegacyCapabilities()
+	caps.Protocol = 2
+	caps.Framing = true
+	board.write(serializeMessage(Message{Message: Hello, Capabilities: caps}))
+	board.write(board.frame("READY"))
+	if msg := receiveMessage(t, msgChan); msg.Message != Hello || !msg.Capabilities.Framing {
+		t.Fatalf("got %+v, want hello with framing", msg)
+	}
+	if msg := receiveMessage(t, msgChan); msg.Message != Ready {
+		t.Fatalf("got %+v, want ready", msg)
+	}
+
+	// a command whose ACK got lost is sent again
+	cmdChan <- NewSetLEDCommand(2, '1')
+	line, seq, payload := board.readFrame()
+	if payload != "RLED.2=1" {
+		t.Fatalf("got %q, want the LED command", payload)
+	}
+	if again, _, _ := board.readFrame(); again != line {
+		t.Fatalf("got %q, want %q sent again", again, line)
+	}
+	board.write(board.frame(fmt.Sprintf("ACK %d", seq)))
+	cmdChan <- NewSetLEDCommand(3, '1')
+	if _, seq, payload = board.readFrame(); payload != "RLED.3=1" {
+		t.Fatalf("got %q after the ACK, want the next LED command", payload)
+	}
+	board.write(board.frame(fmt.Sprintf("ACK %d", seq)))
+	if line, ok := board.readLine(2 * ackTimeout); ok {
+		t.Fatalf("got %q, want nothing once everything is acknowledged", line)
+	}
+
+	// corrupted lines are ignored
+	corrupted := board.frame("RBTN.1=1")
+	board.write(corrupted[:len(corrupted)-4] + "0000")
+	// repeated lines are ignored
+	repeated := board.frame("RBTN.2=1")
+	board.write(repeated)
+	board.write(repeated)
+	board.write(board.frame("RBTN.3=1"))
+	for _, source := range []int{2, 3} {
+		if msg := receiveMessage(t, msgChan); msg.Message != ButtonPressed || msg.Source != source {
+			t.Fatalf("got %+v, want button %d pressed", msg, source)
+		}
+	}
+}
+
+// TestBoardConnRepeatedCommand checks that the board side acknowledges
+// commands sent again but only returns them once.
+func TestBoardConnRepeatedCommand(t *testing.T) {
+	host, conn := net.Pipe()
+	defer host.Close()
+	board := NewBoardConn(conn)
+	board.EnableFraming()
+	hostLines := newRawBoard(t, host)
+
+	commands := make(chan Command, 4)
+	go func() {
+		for {
+			cmd, err := board.Receive()
+			if err != nil {
+				close(commands)
+				return
+			}
+			commands <- cmd
+		}
+	}()
+	first := encodeFrame(1, "RLED.2=1")
+	hostLines.write(first)
+	hostLines.write(first)
+	hostLines.write(encodeFrame(2, "RLED.3=1"))
+	for seq := 1; seq <= 3; seq++ {
+		if _, _, payload := hostLines.readFrame(); !strings.HasPrefix(payload, "ACK ") {
+			t.Fatalf("got %q, want an ACK", payload)
+		}
+	}
+	for _, want := range []Command{NewSetLEDCommand(2, '1'), NewSetLEDCommand(3, '1')} {
+		select {
+		case cmd := <-commands:
+			if cmd != want {
+				t.Fatalf("got %+v, want %+v", cmd, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no command received")
+		}
+	}
+	select {
+	case cmd := <-commands:
+		t.Fatalf("got %+v, want the repeated command ignored", cmd)
+	default:
+	}
+}
@@ -0,0 +1,88 @@
+package comm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// frameBuffer holds the desired state of every LED so only LEDs that actually
+// changed need to be sent to the board.
+type frameBuffer struct {
+	desired map[int]Command
+	// sent is what the board currently shows; LEDs missing here are in an
+	// unknown state, e.g. right after the board has been reset
+	sent  map[int]Command
+	stats frameStats
+}
+
+type frameStats struct {
+	commands   int
+	writes     int
+	merged     int
+	unchanged  int
+	dropped    int
+	maxBacklog int
+	// only used with framed lines
+	retransmits int
+	corrupted   int
+}
+
+func (s frameStats) String() string {
+	return fmt.Sprintf("%d commands, %d led writes, %d merged, %d unchanged, %d dropped, max backlog %d, %d retransmits, %d corrupted lines",
+		s.commands, s.writes, s.merged, s.unchanged, s.dropped, s.maxBacklog, s.retransmits, s.corrupted)
+}
+
+func newFrameBuffer() *frameBuffer {
+	return &frameBuffer{desired: make(map[int]Command), sent: make(map[int]Command)}
+}
+
+// set updates the desired state of an LED.
+func (f *frameBuffer) set(cmd Command) {
+	f.stats.commands++
+	if pending, ok := f.desired[cmd.target]; ok && !pending.sameLED(f.sent[cmd.target]) {
+		// a change that has not been sent yet is replaced
+		f.stats.merged++
+	} else if cmd.sameLED(f.sent[cmd.target]) {
+		f.stats.unchanged++
+	}
+	f.desired[cmd.target] = cmd
+}
+
+// changes returns the commands needed to bring the board to the desired
+// state, ordered by LED.
+func (f *frameBuffer) changes() []Command {
+	var targets []int
+	for target, cmd := range f.desired {
+		if !cmd.sameLED(f.sent[target]) {
+			targets = append(targets, target)
+		}
+	}
+	sort.Ints(targets)
+	cmds := make([]Command, len(targets))
+	for i, target := range targets {
+		cmds[i] = f.desired[target]
+	}
+	return cmds
+}
+
+func (f *frameBuffer) markSent(cmd Command) {
+	f.sent[cmd.target] = cmd
+	f.stats.writes++
+}
+
+// markDropped discards a change the board cannot show.
+func (f *frameBuffer) markDropped(cmd Command) {
+	f.sent[cmd.target] = cmd
+	f.stats.dropped++
+}
+
+// invalidate forgets what the board is showing, so every LED is sent again
+// with the next flush.
+func (f *frameBuffer) invalidate() {
+	f.sent = make(map[int]Command)
+}
+
+func (f *frameBuffer) clear() {
+	f.desired = make(map[int]Command)
+	f.invalidate()
+}
@@ -0,0 +1,118 @@
+package comm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFrameBuffer(t *testing.T) {
+	red := RGB{255, 0, 0}
+	tests := []struct {
+		name string
+		// what the board shows already
+		sent       []Command
+		invalidate bool
+		set        []Command
+		want       []Command
+		merged     int
+		unchanged  int
+	}{
+		{
+			name: "new leds are sent ordered by led",
+			set:  []Command{NewSetLEDCommand(2, '1'), NewSetLEDCommand(0, 'G')},
+			want: []Command{NewSetLEDCommand(0, 'G'), NewSetLEDCommand(2, '1')},
+		},
+		{
+			name:      "unchanged led",
+			sent:      []Command{NewSetLEDCommand(2, '1')},
+			set:       []Command{NewSetLEDCommand(2, '1')},
+			unchanged: 1,
+		},
+		{
+			name: "changed led",
+			sent: []Command{NewSetLEDCommand(2, '1'), NewSetLEDCommand(3, '1')},
+			set:  []Command{NewClearLEDCommand(2), NewSetLEDCommand(3, '1')},
+			want: []Command{NewClearLEDCommand(2)},
+			// LED 3 did not change
+			unchanged: 1,
+		},
+		{
+			name:   "only the last change is sent",
+			set:    []Command{NewSetLEDCommand(0, 'R'), NewSetLEDCommand(0, 'G'), NewSetLEDCommand(0, 'Y')},
+			want:   []Command{NewSetLEDCommand(0, 'Y')},
+			merged: 2,
+		},
+		{
+			name:   "changed back before it was sent",
+			sent:   []Command{NewSetLEDCommand(2, '1')},
+			set:    []Command{NewClearLEDCommand(2), NewSetLEDCommand(2, '1')},
+			merged: 1,
+		},
+		{
+			name:      "same rgb color",
+			sent:      []Command{NewSetRGBLEDCommand(0, red)},
+			set:       []Command{NewSetRGBLEDCommand(0, red)},
+			unchanged: 1,
+		},
+		{
+			name: "different rgb color",
+			sent: []Command{NewSetRGBLEDCommand(0, red)},
+			set:  []Command{NewSetRGBLEDCommand(0, red.Scale(0.5))},
+			want: []Command{NewSetRGBLEDCommand(0, red.Scale(0.5))},
+		},
+		{
+			name:       "everything is sent again after a reset",
+			sent:       []Command{NewSetLEDCommand(2, '1')},
+			invalidate: true,
+			set:        []Command{NewSetLEDCommand(2, '1')},
+			want:       []Command{NewSetLEDCommand(2, '1')},
+			// replaces the state which would have been sent again
+			merged: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFrameBuffer()
+			for _, cmd := range tt.sent {
+				f.set(cmd)
+				f.markSent(cmd)
+			}
+			if tt.invalidate {
+				f.invalidate()
+			}
+			f.stats = frameStats{}
+			for _, cmd := range tt.set {
+				f.set(cmd)
+			}
+			if got := f.changes(); (len(got) > 0 || len(tt.want) > 0) && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got changes %v, want %v", got, tt.want)
+			}
+			if f.stats.merged != tt.merged || f.stats.unchanged != tt.unchanged {
+				t.Errorf("got %d merged and %d unchanged, want %d and %d", f.stats.merged, f.stats.unchanged, tt.merged, tt.unchanged)
+			}
+		})
+	}
+}
+
+func TestFrameBufferSent(t *testing.T) {
+	f := newFrameBuffer()
+	f.set(NewSetLEDCommand(1, '1'))
+	f.set(NewSetLEDCommand(2, 'G'))
+	changes := f.changes()
+	f.markSent(changes[0])
+	// the board cannot show the second change, so it is not tried again
+	f.markDropped(changes[1])
+	if got := f.changes(); len(got) != 0 {
+		t.Errorf("got changes %v after sending everything", got)
+	}
+	if f.stats.writes != 1 || f.stats.dropped != 1 {
+		t.Errorf("got %d writes and %d dropped, want 1 and 1", f.stats.writes, f.stats.dropped)
+	}
+
+	// nothing is left to send once the buffer is cleared
+	f.set(NewClearLEDCommand(1))
+	f.clear()
+	if got := f.changes(); len(got) != 0 {
+		t.Errorf("got changes %v after clearing", got)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package comm
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+func openPTYSlave(path string) (io.ReadWriteCloser, error) {
+	return nil, errors.New("pty transport is only supported on linux")
+}
+
+func OpenPTY() (*os.File, string, error) {
+	return nil, "", errors.New("pty transport is only supported on linux")
+}
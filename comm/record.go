@@ -0,0 +1,139 @@
+package comm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	recordIncoming = "in"
+	recordOutgoing = "out"
+)
+
+// recordEntry is a single line in a recording. Incoming messages and outgoing
+// commands are stored in their protocol representation.
+type recordEntry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Line      string    `json:"line"`
+}
+
+// connection state changes are not part of the protocol but still need to be
+// recorded to reproduce a session
+var pseudoMessages = map[messageKind]string{
+	Connected:    "CONNECTED",
+	Disconnected: "DISCONNECTED",
+}
+
+func recordLine(msg Message) string {
+	if line, ok := pseudoMessages[msg.Message]; ok {
+		return line
+	}
+	return serializeMessage(msg)
+}
+
+func parseRecordLine(line string) Message {
+	for kind, pseudoLine := range pseudoMessages {
+		if line == pseudoLine {
+			return Message{Message: kind}
+		}
+	}
+	return parseMessage(line)
+}
+
+type recorder struct {
+	encoder *json.Encoder
+	mux     sync.Mutex
+}
+
+func (r *recorder) write(direction, line string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if err := r.encoder.Encode(recordEntry{Time: time.Now(), Direction: direction, Line: line}); err != nil {
+		log.Printf("could not write recording: %v\n", err)
+	}
+}
+
+// Record wraps the channels returned by OpenPort and writes every incoming
+// message and outgoing command to w as JSON lines.
+func Record(w io.Writer, msgChan <-chan Message, cmdChan chan<- Command) (<-chan Message, chan<- Command) {
+	r := &recorder{encoder: json.NewEncoder(w)}
+	recMsgChan := make(chan Message, cap(msgChan))
+	recCmdChan := make(chan Command, cap(cmdChan))
+	go func() {
+		for msg := range msgChan {
+			r.write(recordIncoming, recordLine(msg))
+			recMsgChan <- msg
+		}
+		close(recMsgChan)
+	}()
+	go func() {
+		for cmd := range recCmdChan {
+			r.write(recordOutgoing, serializeCommand(cmd))
+			cmdChan <- cmd
+		}
+		close(cmdChan)
+	}()
+	return recMsgChan, recCmdChan
+}
+
+// Replay feeds the incoming messages of a recording back with their original
+// timing divided by speed; a speed of 0 replays everything without delay.
+// Commands sent to the returned channel are only logged. The message channel
+// is closed once the recording has been replayed or ctx is cancelled.
+func Replay(ctx context.Context, r io.Reader, speed float64) (<-chan Message, chan<- Command, error) {
+	var entries []recordEntry
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var entry recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, nil, fmt.Errorf("invalid recording entry in line %d: %v", lineNo, err)
+		}
+		if entry.Direction != recordIncoming {
+			continue
+		}
+		if msg := parseRecordLine(entry.Line); msg.Message == invalid {
+			return nil, nil, fmt.Errorf("invalid message in line %d: %s", lineNo, entry.Line)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("could not read recording: %v", err)
+	}
+
+	msgChan := make(chan Message, 8)
+	cmdChan := make(chan Command, 8)
+	go func() {
+		defer close(msgChan)
+		var hs handshake
+		for i, entry := range entries {
+			var delay time.Duration
+			if i > 0 && speed > 0 {
+				delay = time.Duration(float64(entry.Time.Sub(entries[i-1].Time)) / speed)
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				log.Println("replay cancelled")
+				return
+			}
+			log.Printf("replaying %s\n", entry.Line)
+			msg := parseRecordLine(entry.Line)
+			hs.handle(&msg)
+			msgChan <- msg
+		}
+		log.Println("replay finished")
+	}()
+	go func() {
+		for cmd := range cmdChan {
+			log.Printf("replay: %s\n", serializeCommand(cmd))
+		}
+	}()
+	return msgChan, cmdChan, nil
+}
@@ -0,0 +1,154 @@
+package comm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	messages := []Message{
+		{Message: Connected},
+		{Message: Ready, Capabilities: LegacyCapabilities()},
+		{Message: ButtonPressed, Source: 1},
+		{Message: KnobTurned, Source: 0, Value: -2},
+		{Message: ButtonReleased, Source: 1},
+		{Message: Disconnected},
+	}
+	commands := []Command{NewResetCommand(), NewSetLEDCommand(2, 'G'), NewSetRGBLEDCommand(0, RGB{255, 128, 0}), NewClearLEDCommand(2)}
+
+	var recording bytes.Buffer
+	msgChan := make(chan Message, len(messages))
+	cmdChan := make(chan Command, len(commands))
+	recMsgChan, recCmdChan := Record(&recording, msgChan, cmdChan)
+	// messages and commands are passed on unchanged
+	for _, msg := range messages {
+		msgChan <- msg
+	}
+	close(msgChan)
+	var passed []Message
+	for msg := range recMsgChan {
+		passed = append(passed, msg)
+	}
+	if !reflect.DeepEqual(passed, messages) {
+		t.Errorf("got messages %+v, want %+v", passed, messages)
+	}
+	for _, cmd := range commands {
+		recCmdChan <- cmd
+	}
+	close(recCmdChan)
+	var sent []Command
+	for cmd := range cmdChan {
+		sent = append(sent, cmd)
+	}
+	if !reflect.DeepEqual(sent, commands) {
+		t.Errorf("got commands %+v, want %+v", sent, commands)
+	}
+
+	wantLines := []string{
+		"in CONNECTED", "in READY", "in RBTN.1=1", "in RVAL.0=-2", "in RBTN.1=0", "in DISCONNECTED",
+		"out RST", "out RLED.2=G", "out RLED.0=#ff8000", "out RLED.2=0",
+	}
+	var gotLines []string
+	for _, line := range strings.Split(strings.TrimSpace(recording.String()), "\n") {
+		var entry recordEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if entry.Time.IsZero() {
+			t.Errorf("%s has no time", line)
+		}
+		gotLines = append(gotLines, entry.Direction+" "+entry.Line)
+	}
+	if !reflect.DeepEqual(gotLines, wantLines) {
+		t.Errorf("got recording %q, want %q", gotLines, wantLines)
+	}
+
+	// replaying skips the commands and restores the capabilities of the board
+	replayed, replayCmdChan, err := Replay(context.Background(), &recording, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(replayCmdChan)
+	var got []Message
+	for msg := range replayed {
+		got = append(got, msg)
+	}
+	if !reflect.DeepEqual(got, messages) {
+		t.Errorf("got replayed messages %+v, want %+v", got, messages)
+	}
+}
+
+// recordingOf creates a recording of incoming lines which are a second apart.
+func recordingOf(lines ...string) string {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var b strings.Builder
+	for i, line := range lines {
+		data, _ := json.Marshal(recordEntry{Time: start.Add(time.Duration(i) * time.Second), Direction: recordIncoming, Line: line})
+		fmt.Fprintf(&b, "%s\n", data)
+	}
+	return b.String()
+}
+
+func TestReplayErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		recording string
+		wantErr   bool
+	}{
+		{name: "empty"},
+		{name: "messages", recording: recordingOf("CONNECTED", "READY", "RBTN.1=1")},
+		{
+			name:      "invalid commands are not replayed",
+			recording: recordingOf("READY") + `{"time":"2024-01-01T12:00:00Z","dir":"out","line":"garbage"}` + "\n",
+		},
+		{name: "invalid json", recording: "{\n", wantErr: true},
+		{name: "invalid message", recording: recordingOf("READY", "RBTN.x=1"), wantErr: true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		msgChan, _, err := Replay(ctx, strings.NewReader(tt.recording), 0)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want an error: %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil {
+			for range msgChan {
+			}
+		}
+		cancel()
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	// three seconds of recording replayed 100 times faster
+	recording := recordingOf("READY", "RBTN.1=1", "RBTN.1=0", "RVAL.0=1")
+	msgChan, _, err := Replay(context.Background(), strings.NewReader(recording), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for range msgChan {
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond || elapsed > time.Second {
+		t.Errorf("replay took %v, want about 30ms", elapsed)
+	}
+
+	// cancelling stops the replay at its original speed
+	ctx, cancel := context.WithCancel(context.Background())
+	msgChan, _, err = Replay(ctx, strings.NewReader(recording), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveMessage(t, msgChan); msg.Message != Ready {
+		t.Fatalf("got %+v, want ready", msg)
+	}
+	cancel()
+	for msg := range msgChan {
+		t.Errorf("got %+v after cancelling", msg)
+	}
+}
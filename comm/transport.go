@@ -0,0 +1,157 @@
+package comm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const defaultBaud = 19200
+
+// Transport is a way to reach a rotaryboard. Open may be called again after
+// a previous connection has been closed.
+type Transport interface {
+	Open() (io.ReadWriteCloser, error)
+	String() string
+}
+
+// ParseTransport creates a transport from a port spec. A bare device name such
+// as `COM4` or `/dev/ttyUSB0` is a serial port; otherwise the scheme selects
+// the transport:
+//
+//	serial://COM4?baud=19200
+//	tcp://192.168.1.20:2000
+//	pty:///dev/pts/3
+//	pipe://name
+//	usb://1a86:7523?serial=A5069RR4&baud=19200
+func ParseTransport(spec string) (Transport, error) {
+	if rest, ok := strings.CutPrefix(spec, "usb://"); ok {
+		// product ids are hex so they cannot be parsed as the port of a url
+		return parseUSBTransport(rest)
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// no scheme (or a windows drive letter): plain serial device name
+		return &SerialTransport{Name: spec, Baud: defaultBaud}, nil
+	}
+	device := u.Host + u.Path
+	switch u.Scheme {
+	case "serial":
+		baud := defaultBaud
+		if s := u.Query().Get("baud"); s != "" {
+			if baud, err = strconv.Atoi(s); err != nil || baud <= 0 {
+				return nil, fmt.Errorf("invalid baud rate: %s", s)
+			}
+		}
+		if device == "" {
+			return nil, errors.New("no serial device specified")
+		}
+		return &SerialTransport{Name: device, Baud: baud}, nil
+	case "tcp":
+		if u.Host == "" {
+			return nil, errors.New("no tcp address specified")
+		}
+		return &TCPTransport{Address: u.Host}, nil
+	case "pty":
+		if u.Path == "" {
+			return nil, errors.New("no pty path specified")
+		}
+		return &PTYTransport{Path: u.Path}, nil
+	case "pipe":
+		pipe := lookupPipe(device)
+		if pipe == nil {
+			return nil, fmt.Errorf("no pipe named %q", device)
+		}
+		return pipe, nil
+	default:
+		return nil, fmt.Errorf("unknown transport: %s", u.Scheme)
+	}
+}
+
+// SerialTransport talks to a board attached to a local serial port.
+type SerialTransport struct {
+	Name string
+	Baud int
+}
+
+func (t *SerialTransport) Open() (io.ReadWriteCloser, error) {
+	return serial.OpenPort(&serial.Config{Name: t.Name, Baud: t.Baud})
+}
+
+func (t *SerialTransport) String() string {
+	return fmt.Sprintf("serial port %s", t.Name)
+}
+
+// TCPTransport talks to a board exposed over the network, e.g. by ser2net or
+// an ESP serial bridge.
+type TCPTransport struct {
+	Address string
+}
+
+func (t *TCPTransport) Open() (io.ReadWriteCloser, error) {
+	return net.DialTimeout("tcp", t.Address, 5*time.Second)
+}
+
+func (t *TCPTransport) String() string {
+	return fmt.Sprintf("tcp %s", t.Address)
+}
+
+// PTYTransport talks to a board (usually a simulator) on the slave side of a
+// pseudo-terminal.
+type PTYTransport struct {
+	Path string
+}
+
+func (t *PTYTransport) Open() (io.ReadWriteCloser, error) {
+	return openPTYSlave(t.Path)
+}
+
+func (t *PTYTransport) String() string {
+	return fmt.Sprintf("pty %s", t.Path)
+}
+
+// PipeTransport is an in-memory transport. Every call to Open creates a new
+// pipe and hands the board end of it to whoever receives from Boards.
+type PipeTransport struct {
+	Name   string
+	Boards chan io.ReadWriteCloser
+}
+
+var (
+	pipes    = make(map[string]*PipeTransport)
+	pipesMux sync.Mutex
+)
+
+// NewPipeTransport creates an in-memory transport that can also be referenced
+// as `pipe://name` in a port spec.
+func NewPipeTransport(name string) *PipeTransport {
+	t := &PipeTransport{Name: name, Boards: make(chan io.ReadWriteCloser, 1)}
+	pipesMux.Lock()
+	pipes[name] = t
+	pipesMux.Unlock()
+	return t
+}
+
+func lookupPipe(name string) *PipeTransport {
+	pipesMux.Lock()
+	defer pipesMux.Unlock()
+	return pipes[name]
+}
+
+func (t *PipeTransport) Open() (io.ReadWriteCloser, error) {
+	host, board := net.Pipe()
+	t.Boards <- board
+	return host, nil
+}
+
+func (t *PipeTransport) String() string {
+	return fmt.Sprintf("pipe %s", t.Name)
+}
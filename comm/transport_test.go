@@ -0,0 +1,147 @@
+package comm
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTransport(t *testing.T) {
+	pipe := NewPipeTransport("parse")
+	tests := []struct {
+		spec string
+		want Transport
+	}{
+		{"COM4", &SerialTransport{Name: "COM4", Baud: defaultBaud}},
+		{"/dev/ttyUSB0", &SerialTransport{Name: "/dev/ttyUSB0", Baud: defaultBaud}},
+		{"serial://COM4?baud=9600", &SerialTransport{Name: "COM4", Baud: 9600}},
+		{"tcp://192.168.1.20:2000", &TCPTransport{Address: "192.168.1.20:2000"}},
+		{"pty:///dev/pts/3", &PTYTransport{Path: "/dev/pts/3"}},
+		{"pipe://parse", pipe},
+		{"usb://1A86:7523?serial=A5069RR4", &USBTransport{Vendor: "1a86", Product: "7523", Serial: "A5069RR4", Baud: defaultBaud}},
+		{"serial://COM4?baud=fast", nil},
+		{"tcp://", nil},
+		{"pipe://unknown", nil},
+		{"usb://1a86", nil},
+		{"carrier-pigeon://coop", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseTransport(tt.spec)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.spec, got)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, %v, want %v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+// receiveMessage waits for the next message from the host side of a port.
+func receiveMessage(t *testing.T, msgChan <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-msgChan:
+		if !ok {
+			t.Fatal("message channel closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+// connectBoard accepts the next connection on a pipe and completes the
+// handshake on the board side.
+func connectBoard(t *testing.T, pipe *PipeTransport, msgChan <-chan Message) (*BoardConn, io.Closer) {
+	t.Helper()
+	var conn io.ReadWriteCloser
+	select {
+	case conn = <-pipe.Boards:
+	case <-time.After(5 * time.Second):
+		t.Fatal("host did not connect")
+	}
+	board := NewBoardConn(conn)
+	if msg := receiveMessage(t, msgChan); msg.Message != Connected {
+		t.Fatalf("got %+v, want connected", msg)
+	}
+	if cmd, err := board.Receive(); err != nil || !cmd.IsReset() {
+		t.Fatalf("got %+v, %v, want a reset", cmd, err)
+	}
+	caps := LegacyCapabilities()
+	caps.Protocol = 2
+	caps.Firmware = "test"
+	if err := board.Send(Message{Message: Hello, Capabilities: caps}); err != nil {
+		t.Fatal(err)
+	}
+	if err := board.Send(Message{Message: Ready}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveMessage(t, msgChan); msg.Message != Hello {
+		t.Fatalf("got %+v, want hello", msg)
+	}
+	if msg := receiveMessage(t, msgChan); msg.Message != Ready || msg.Capabilities.Firmware != "test" {
+		t.Fatalf("got %+v, want ready", msg)
+	}
+	return board, conn
+}
+
+// TestPipeTransport runs a board on an in-memory pipe through connecting,
+// exchanging messages and commands, reconnecting and shutting down.
+func TestPipeTransport(t *testing.T) {
+	pipe := NewPipeTransport("board")
+	transport, err := ParseTransport("pipe://board")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgChan, cmdChan := OpenPort(ctx, transport)
+
+	board, conn := connectBoard(t, pipe, msgChan)
+	cmdChan <- NewSetLEDCommand(2, '1')
+	if cmd, err := board.Receive(); err != nil || cmd != NewSetLEDCommand(2, '1') {
+		t.Fatalf("got %+v, %v, want the LED command", cmd, err)
+	}
+	// invalid commands are dropped
+	cmdChan <- Command{}
+	cmdChan <- NewSetLEDCommand(3, '1')
+	if cmd, err := board.Receive(); err != nil || cmd != NewSetLEDCommand(3, '1') {
+		t.Fatalf("got %+v, %v, want the command after the invalid one", cmd, err)
+	}
+	if err := board.Send(Message{Message: ButtonPressed, Source: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveMessage(t, msgChan); msg.Message != ButtonPressed || msg.Source != 1 {
+		t.Fatalf("got %+v, want the button press", msg)
+	}
+
+	// the host reconnects and restores the LEDs once the board is ready again
+	conn.Close()
+	if msg := receiveMessage(t, msgChan); msg.Message != Disconnected {
+		t.Fatalf("got %+v, want disconnected", msg)
+	}
+	board, _ = connectBoard(t, pipe, msgChan)
+	for _, want := range []Command{NewSetLEDCommand(2, '1'), NewSetLEDCommand(3, '1')} {
+		if cmd, err := board.Receive(); err != nil || cmd != want {
+			t.Fatalf("got %+v, %v, want the restored LED %+v", cmd, err, want)
+		}
+	}
+
+	// shutting down resets the board and closes the message channel
+	cancel()
+	if cmd, err := board.Receive(); err != nil || !cmd.IsReset() {
+		t.Fatalf("got %+v, %v, want a reset", cmd, err)
+	}
+	select {
+	case _, ok := <-msgChan:
+		if ok {
+			t.Fatal("message channel not closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message channel not closed")
+	}
+}
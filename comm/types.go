@@ -10,6 +10,9 @@ const (
 	KnobTurned
 	ButtonPressed
 	ButtonReleased
+	Connected
+	Disconnected
+	Hello
 )
 
 // commandKind
@@ -18,16 +21,22 @@ const (
 	reset
 	clearLED
 	setLED
+	setRGBLED
 )
 
 type Message struct {
-	Message messageKind
-	Source  int
-	Value   int
+	Message      messageKind
+	Source       int
+	Value        int
+	Capabilities *Capabilities
+	// Board is the ID of the board that sent the message; it is set by the
+	// controller when messages from several boards are merged.
+	Board string
 }
 
 type Command struct {
 	command commandKind
 	target  int
 	color   byte
+	rgb     RGB
 }
@@ -0,0 +1,241 @@
+package comm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSysfsRoot = "/sys"
+	// how often to look for a board that is not plugged in, and whether a
+	// connected board is still there
+	usbPollInterval = 1 * time.Second
+)
+
+// ErrDeviceNotPresent is returned by transports whose device is currently not
+// plugged in. The port is then polled instead of backing off.
+var ErrDeviceNotPresent = errors.New("device not present")
+
+// USBDevice is a serial device of a USB device found in sysfs.
+type USBDevice struct {
+	// Device is the path of the serial device, e.g. /dev/ttyACM0.
+	Device  string
+	Vendor  string
+	Product string
+	Serial  string
+}
+
+func (d USBDevice) String() string {
+	s := fmt.Sprintf("%s (%s:%s", d.Device, d.Vendor, d.Product)
+	if d.Serial != "" {
+		s += ", serial " + d.Serial
+	}
+	return s + ")"
+}
+
+// FindUSBDevices lists all serial devices that belong to a USB device. It
+// scans the tty class of the sysfs tree at root, which is /sys on a real
+// Linux system.
+func FindUSBDevices(root string) ([]USBDevice, error) {
+	entries, err := os.ReadDir(filepath.Join(root, "class", "tty"))
+	if err != nil {
+		return nil, err
+	}
+	var devices []USBDevice
+	for _, entry := range entries {
+		path, err := filepath.EvalSymlinks(filepath.Join(root, "class", "tty", entry.Name(), "device"))
+		if err != nil {
+			// virtual terminals have no device
+			continue
+		}
+		usbPath := findUSBParent(root, path)
+		if usbPath == "" {
+			continue
+		}
+		devices = append(devices, USBDevice{
+			Device:  "/dev/" + entry.Name(),
+			Vendor:  readSysfsAttribute(usbPath, "idVendor"),
+			Product: readSysfsAttribute(usbPath, "idProduct"),
+			Serial:  readSysfsAttribute(usbPath, "serial"),
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Device < devices[j].Device
+	})
+	return devices, nil
+}
+
+// findUSBParent returns the closest parent of a device that is a USB device,
+// i.e. has a vendor id.
+func findUSBParent(root, path string) string {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return ""
+	}
+	for strings.HasPrefix(path, root) && path != root {
+		if _, err := os.Stat(filepath.Join(path, "idVendor")); err == nil {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+	return ""
+}
+
+func readSysfsAttribute(path, name string) string {
+	data, err := os.ReadFile(filepath.Join(path, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// USBTransport talks to a board identified by its USB vendor id, product id
+// and optionally serial number, no matter which serial device it gets. It
+// connects once the board is plugged in and disconnects when it goes away.
+// Discovery relies on sysfs and thus only works on Linux.
+type USBTransport struct {
+	Vendor  string
+	Product string
+	Serial  string
+	Baud    int
+	// SysfsRoot is where sysfs is mounted; it defaults to /sys.
+	SysfsRoot string
+}
+
+func (t *USBTransport) matches(d USBDevice) bool {
+	return strings.EqualFold(d.Vendor, t.Vendor) && strings.EqualFold(d.Product, t.Product) &&
+		(t.Serial == "" || d.Serial == t.Serial)
+}
+
+func (t *USBTransport) sysfsRoot() string {
+	if t.SysfsRoot == "" {
+		return defaultSysfsRoot
+	}
+	return t.SysfsRoot
+}
+
+// find returns the board's serial device.
+func (t *USBTransport) find() (USBDevice, error) {
+	devices, err := FindUSBDevices(t.sysfsRoot())
+	if err != nil {
+		return USBDevice{}, fmt.Errorf("could not scan usb devices: %v", err)
+	}
+	var found []USBDevice
+	for _, d := range devices {
+		if t.matches(d) {
+			found = append(found, d)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return USBDevice{}, ErrDeviceNotPresent
+	case 1:
+		return found[0], nil
+	default:
+		return USBDevice{}, fmt.Errorf("%d matching devices found, specify a serial number", len(found))
+	}
+}
+
+func (t *USBTransport) Open() (io.ReadWriteCloser, error) {
+	device, err := t.find()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("found %s at %s\n", t, device.Device)
+	port, err := (&SerialTransport{Name: device.Device, Baud: t.Baud}).Open()
+	if err != nil {
+		return nil, err
+	}
+	conn := &usbConn{ReadWriteCloser: port, closed: make(chan struct{})}
+	go t.watch(conn, device)
+	return conn, nil
+}
+
+// watch closes the connection as soon as the device disappears, e.g. because
+// the board has been unplugged.
+func (t *USBTransport) watch(conn *usbConn, device USBDevice) {
+	ticker := time.NewTicker(usbPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case <-ticker.C:
+			if current, err := t.find(); err != nil || current.Device != device.Device {
+				log.Printf("%s went away\n", t)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (t *USBTransport) String() string {
+	s := fmt.Sprintf("usb device %s:%s", t.Vendor, t.Product)
+	if t.Serial != "" {
+		s += fmt.Sprintf(" (serial %s)", t.Serial)
+	}
+	return s
+}
+
+type usbConn struct {
+	io.ReadWriteCloser
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *usbConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.ReadWriteCloser.Close()
+	})
+	return err
+}
+
+func parseUSBTransport(spec string) (*USBTransport, error) {
+	device, rawQuery, _ := strings.Cut(spec, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid usb options: %v", err)
+	}
+	vendor, product, _ := strings.Cut(device, ":")
+	if !isUSBID(vendor) || !isUSBID(product) {
+		return nil, fmt.Errorf("invalid usb device: %s (expected vendor:product)", device)
+	}
+	baud := defaultBaud
+	if s := query.Get("baud"); s != "" {
+		if baud, err = strconv.Atoi(s); err != nil || baud <= 0 {
+			return nil, fmt.Errorf("invalid baud rate: %s", s)
+		}
+	}
+	return &USBTransport{
+		Vendor:    strings.ToLower(vendor),
+		Product:   strings.ToLower(product),
+		Serial:    query.Get("serial"),
+		Baud:      baud,
+		SysfsRoot: query.Get("sysfs"),
+	}, nil
+}
+
+func isUSBID(s string) bool {
+	if len(s) != 4 {
+		return false
+	}
+	for _, c := range strings.ToLower(s) {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
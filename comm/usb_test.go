@@ -0,0 +1,176 @@
+package comm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeSysfs is a sysfs tree with the parts FindUSBDevices looks at.
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	s := &fakeSysfs{t: t, root: t.TempDir()}
+	s.mkdir("class", "tty")
+	// a virtual terminal without a device
+	s.mkdir("class", "tty", "tty0")
+	// a serial port which is not a USB device
+	s.mkdir("devices", "platform", "serial8250")
+	s.addTTY("ttyS0", filepath.Join("devices", "platform", "serial8250"))
+	return s
+}
+
+func (s *fakeSysfs) mkdir(elem ...string) string {
+	path := filepath.Join(append([]string{s.root}, elem...)...)
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		s.t.Fatal(err)
+	}
+	return path
+}
+
+func (s *fakeSysfs) writeAttribute(dir, name, value string) {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0o644); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// addTTY adds a tty whose device is the directory at devicePath, relative to
+// the root.
+func (s *fakeSysfs) addTTY(name, devicePath string) {
+	dir := s.mkdir("class", "tty", name)
+	target, err := filepath.Rel(dir, filepath.Join(s.root, devicePath))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "device")); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// addUSB adds a USB device at a port with a serial interface whose tty is
+// name, like a board using the CDC ACM driver.
+func (s *fakeSysfs) addUSB(name, port, vendor, product, serial string) {
+	usbDir := s.mkdir("devices", "pci0000:00", "usb1", port)
+	s.writeAttribute(usbDir, "idVendor", vendor)
+	s.writeAttribute(usbDir, "idProduct", product)
+	if serial != "" {
+		s.writeAttribute(usbDir, "serial", serial)
+	}
+	s.mkdir("devices", "pci0000:00", "usb1", port, port+":1.0", "tty", name)
+	s.addTTY(name, filepath.Join("devices", "pci0000:00", "usb1", port, port+":1.0"))
+}
+
+// unplug removes a USB device and its tty like the kernel does when the device
+// goes away.
+func (s *fakeSysfs) unplug(name, port string) {
+	for _, path := range []string{
+		filepath.Join(s.root, "class", "tty", name),
+		filepath.Join(s.root, "devices", "pci0000:00", "usb1", port),
+	} {
+		if err := os.RemoveAll(path); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+}
+
+func TestFindUSBDevices(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.addUSB("ttyACM1", "1-2", "1209", "0001", "")
+	sysfs.addUSB("ttyACM0", "1-1", "2341", "8036", "ABC123")
+
+	devices, err := FindUSBDevices(sysfs.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []USBDevice{
+		{Device: "/dev/ttyACM0", Vendor: "2341", Product: "8036", Serial: "ABC123"},
+		{Device: "/dev/ttyACM1", Vendor: "1209", Product: "0001"},
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("got %v, want %v", devices, want)
+	}
+}
+
+func TestUSBTransportFind(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.addUSB("ttyACM0", "1-1", "2341", "8036", "ABC123")
+	sysfs.addUSB("ttyACM1", "1-2", "2341", "8036", "DEF456")
+	sysfs.addUSB("ttyUSB0", "1-3", "1209", "0001", "")
+	sysfs.addUSB("ttyUSB1", "1-4", "16c0", "05df", "")
+
+	tests := []struct {
+		name    string
+		spec    string
+		device  string
+		wantErr error
+	}{
+		{name: "match", spec: "1209:0001", device: "/dev/ttyUSB0"},
+		{name: "ids are case-insensitive", spec: "16C0:05DF", device: "/dev/ttyUSB1"},
+		{name: "serial", spec: "2341:8036?serial=ABC123", device: "/dev/ttyACM0"},
+		{name: "other serial", spec: "2341:8036?serial=DEF456", device: "/dev/ttyACM1"},
+		{name: "ambiguous", spec: "2341:8036"},
+		{name: "unknown serial", spec: "2341:8036?serial=XYZ", wantErr: ErrDeviceNotPresent},
+		{name: "not plugged in", spec: "0483:5740", wantErr: ErrDeviceNotPresent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := parseUSBTransport(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport.SysfsRoot = sysfs.root
+			device, err := transport.find()
+			switch {
+			case tt.device != "":
+				if err != nil || device.Device != tt.device {
+					t.Errorf("got %v, %v, want %s", device, err, tt.device)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("got %v, %v, want %v", device, err, tt.wantErr)
+				}
+			default:
+				if err == nil || errors.Is(err, ErrDeviceNotPresent) {
+					t.Errorf("got %v, %v, want an ambiguity error", device, err)
+				}
+			}
+		})
+	}
+}
+
+type nopReadWriteCloser struct {
+	io.ReadWriter
+}
+
+func (nopReadWriteCloser) Close() error {
+	return nil
+}
+
+func TestUSBTransportUnplug(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.addUSB("ttyACM0", "1-1", "2341", "8036", "")
+	transport := &USBTransport{Vendor: "2341", Product: "8036", SysfsRoot: sysfs.root}
+	device, err := transport.find()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &usbConn{ReadWriteCloser: nopReadWriteCloser{}, closed: make(chan struct{})}
+	go transport.watch(conn, device)
+	sysfs.unplug("ttyACM0", "1-1")
+	select {
+	case <-conn.closed:
+	case <-time.After(3 * usbPollInterval):
+		t.Fatal("connection not closed after the device went away")
+	}
+	if _, err := transport.find(); !errors.Is(err, ErrDeviceNotPresent) {
+		t.Errorf("got %v after unplugging, want %v", err, ErrDeviceNotPresent)
+	}
+}
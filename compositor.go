@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/thiefmaster/controller/comm"
+	"github.com/thiefmaster/controller/hardware"
+	"gopkg.in/yaml.v2"
+)
+
+type ledLayer int
+
+// LED layers from lowest to highest priority
+const (
+	layerBase ledLayer = iota
+	layerNotification
+	layerFeedback
+	layerAlert
+	numLayers
+)
+
+var layerNames = []string{"base", "notification", "feedback", "alert"}
+
+func (l ledLayer) String() string {
+	return layerNames[l]
+}
+
+func (l *ledLayer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+	for i, layerName := range layerNames {
+		if name == layerName {
+			*l = ledLayer(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown led layer: %s", name)
+}
+
+var _ yaml.Unmarshaler = (*ledLayer)(nil)
+
+type ledClaim struct {
+	owner string
+	cmd   comm.Command
+}
+
+type ledOwnership struct {
+	LED   string `json:"led"`
+	Layer string `json:"layer"`
+	Owner string `json:"owner"`
+	Color string `json:"color"`
+}
+
+// compositor decides what each LED shows. Subsystems claim LEDs on a layer
+// and the claim on the highest layer is visible on the board.
+type compositor struct {
+	profile *hardware.Profile
+	out     chan<- comm.Command
+	claims  map[int]*[numLayers]*ledClaim
+	visible map[int]comm.Command
+	// claims below this layer are ignored, e.g. while shutting down
+	minLayer ledLayer
+	// claims on hidden layers are ignored, e.g. during quiet hours
+	hidden [numLayers]bool
+	// scales RGB colors
+	brightness float64
+	mux        sync.Mutex
+}
+
+func newCompositor(profile *hardware.Profile, out chan<- comm.Command) *compositor {
+	return &compositor{
+		profile:    profile,
+		out:        out,
+		claims:     make(map[int]*[numLayers]*ledClaim),
+		visible:    make(map[int]comm.Command),
+		brightness: 1,
+	}
+}
+
+// channel returns a channel through which owner can claim LEDs on a layer.
+// On all layers except the base layer, turning an LED off releases the claim
+// so lower layers become visible again. Closing the channel releases all
+// claims of owner.
+func (c *compositor) channel(layer ledLayer, owner string) chan<- comm.Command {
+	cmdChan := make(chan comm.Command, 8)
+	go func() {
+		for cmd := range cmdChan {
+			if cmd.IsReset() {
+				continue
+			}
+			c.mux.Lock()
+			if layer != layerBase && cmd.Color() == '0' {
+				c.release(layer, owner, cmd.Target())
+			} else {
+				c.claim(layer, owner, cmd)
+			}
+			c.mux.Unlock()
+		}
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		for _, led := range c.profile.LEDs {
+			c.release(layer, owner, led.Index)
+		}
+	}()
+	return cmdChan
+}
+
+// claim sets what an LED shows on a layer. Must be called with the mutex
+// held.
+func (c *compositor) claim(layer ledLayer, owner string, cmd comm.Command) {
+	layers := c.claims[cmd.Target()]
+	if layers == nil {
+		layers = &[numLayers]*ledClaim{}
+		c.claims[cmd.Target()] = layers
+	}
+	layers[layer] = &ledClaim{owner: owner, cmd: cmd}
+	c.update(cmd.Target())
+}
+
+// release removes the claim of owner on a layer. Must be called with the mutex
+// held.
+func (c *compositor) release(layer ledLayer, owner string, target int) {
+	layers := c.claims[target]
+	if layers == nil || layers[layer] == nil || layers[layer].owner != owner {
+		return
+	}
+	layers[layer] = nil
+	c.update(target)
+}
+
+// top returns the visible claim on an LED and its layer. Must be called with
+// the mutex held.
+func (c *compositor) top(target int) (*ledClaim, ledLayer) {
+	if layers := c.claims[target]; layers != nil {
+		for layer := numLayers - 1; layer >= c.minLayer; layer-- {
+			if claim := layers[layer]; claim != nil && !c.hidden[layer] {
+				return claim, layer
+			}
+		}
+	}
+	return nil, 0
+}
+
+// update sends the visible state of an LED to the board if it changed.
+func (c *compositor) update(target int) {
+	cmd := comm.NewClearLEDCommand(target)
+	if claim, _ := c.top(target); claim != nil {
+		cmd = claim.cmd
+	}
+	if rgb, ok := cmd.RGB(); ok && c.brightness < 1 {
+		cmd = comm.NewSetRGBLEDCommand(target, rgb.Scale(c.brightness))
+	}
+	if current, ok := c.visible[target]; ok && current == cmd {
+		return
+	}
+	c.visible[target] = cmd
+	c.out <- cmd
+}
+
+// base returns the command claimed on the base layer of an LED.
+func (c *compositor) base(target int) (comm.Command, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if layers := c.claims[target]; layers != nil && layers[layerBase] != nil {
+		return layers[layerBase].cmd, true
+	}
+	return comm.Command{}, false
+}
+
+// restrict hides all layers below minLayer, e.g. to only show the outro while
+// shutting down.
+func (c *compositor) restrict(minLayer ledLayer) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.minLayer = minLayer
+	for _, led := range c.profile.LEDs {
+		c.update(led.Index)
+	}
+}
+
+// show sets which layers are hidden and how bright RGB colors are, e.g. when
+// the behavior changes.
+func (c *compositor) show(hidden [numLayers]bool, brightness float64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.hidden = hidden
+	c.brightness = brightness
+	for _, led := range c.profile.LEDs {
+		c.update(led.Index)
+	}
+}
+
+// ownership lists which layer and owner currently control each LED.
+func (c *compositor) ownership() []ledOwnership {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var result []ledOwnership
+	for _, led := range c.profile.LEDs {
+		entry := ledOwnership{LED: led.Name, Layer: "-", Owner: "-", Color: "0"}
+		if claim, layer := c.top(led.Index); claim != nil {
+			entry.Layer = layer.String()
+			entry.Owner = claim.owner
+		}
+		if cmd, ok := c.visible[led.Index]; ok {
+			entry.Color = describeColor(cmd)
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+func describeColor(cmd comm.Command) string {
+	if rgb, ok := cmd.RGB(); ok {
+		return rgb.String()
+	}
+	return string(cmd.Color())
+}
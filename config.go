@@ -5,18 +5,60 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"maps"
+	"slices"
+	"time"
 
 	"github.com/thiefmaster/controller/apis"
+	"github.com/thiefmaster/controller/comm"
+	"github.com/thiefmaster/controller/hardware"
 	"gopkg.in/yaml.v2"
 )
 
 type appConfig struct {
-	Port           string
-	Foobar         apis.HTTPCredentials
-	NotHub         apis.HTTPCredentials
-	Mattermost     apis.MattermostSettings
-	TubeRemotePort int `yaml:"tubeRemotePort"`
-	Numlock        bool
+	Port       string
+	Profile    string
+	Boards     []*boardConfig
+	Colors     map[string]string
+	Animations map[string]animation
+	DebugPort  int `yaml:"debugPort"`
+	Keymap     map[string]string
+	Gestures   gestureSettings
+	Modes      []string
+	Plugins    map[string]apis.PluginSettings
+	Scripts    map[string]scriptSettings
+	Macros     string
+	Behaviors  map[string]*behavior
+	Schedule   []*scheduleRule
+	DND        dndSettings `yaml:"dnd"`
+	// the sections of the integrations, e.g. `foobar` or `mattermost`
+	Integrations map[string]any `yaml:",inline"`
+	boards       *boardSet
+	profile      *hardware.Profile
+	colors       map[string]comm.RGB
+	animations   map[string]animation
+	keymap       keymap
+	modes        []mode
+	integrations []apis.Integration
+	scripts      map[string]*script
+	// the behaviors in the order showBehavior shows them
+	behaviorOrder []string
+}
+
+type gestureSettings struct {
+	LongPress time.Duration `yaml:"longPress"`
+	DoubleTap time.Duration `yaml:"doubleTap"`
+}
+
+// things that can be given their own color in the `colors` section
+var colorKeys = []string{
+	"foobar",
+	"youtube",
+	"mattermost",
+	"mattermostMentions",
+	"nothub",
+	"nothubHighlights",
+	"nothubCommits",
 }
 
 func (c *appConfig) load(path string) error {
@@ -31,29 +73,192 @@ func (c *appConfig) load(path string) error {
 	if err := c.validate(); err != nil {
 		return fmt.Errorf("config invalid: %v", err)
 	}
+	if c.integrations, err = apis.Configure(c.Integrations); err != nil {
+		return fmt.Errorf("config invalid: %v", err)
+	}
+	plugins, err := apis.ConfigurePlugins(c.Plugins)
+	if err != nil {
+		return fmt.Errorf("config invalid: %v", err)
+	}
+	c.integrations = append(c.integrations, plugins...)
+	if err := c.loadBoards(); err != nil {
+		return err
+	}
+	if err := c.loadAnimations(); err != nil {
+		return fmt.Errorf("config invalid: %v", err)
+	}
+	if err := c.loadScripts(); err != nil {
+		return fmt.Errorf("config invalid: %v", err)
+	}
+	// bindings may switch to a mode
+	if err := c.loadModes(); err != nil {
+		return fmt.Errorf("config invalid: %v", err)
+	}
+	if err := c.loadBehaviors(); err != nil {
+		return fmt.Errorf("config invalid: %v", err)
+	}
+	if err := c.loadDND(); err != nil {
+		return fmt.Errorf("config invalid: %v", err)
+	}
+	overrides := maps.Clone(c.Keymap)
+	if overrides == nil {
+		overrides = make(map[string]string)
+	}
+	for _, b := range c.boards.boards {
+		bindings, err := c.boards.keymap(b)
+		if err != nil {
+			return fmt.Errorf("config invalid: %v", err)
+		}
+		maps.Copy(overrides, bindings)
+	}
+	if c.keymap, err = loadKeymap(c.profile, overrides, c.findAction); err != nil {
+		return fmt.Errorf("config invalid: %v", err)
+	}
+	if c.Macros == "" {
+		c.Macros = defaultMacroFile
+	}
 	return nil
 }
 
-func (c *appConfig) validate() error {
-	if c.Port == "" {
-		return errors.New("no port specified")
+func (c *appConfig) loadModes() error {
+	if len(c.Modes) == 0 {
+		for _, m := range availableModes {
+			if m.enabled(c) {
+				c.modes = append(c.modes, m)
+			}
+		}
+		return nil
 	}
-	if c.Foobar.BaseURL == "" {
-		return errors.New("no foobar url specified")
+	for _, name := range c.Modes {
+		m, ok := findMode(name)
+		if !ok {
+			return fmt.Errorf("unknown mode: %s", name)
+		}
+		if !m.enabled(c) {
+			return fmt.Errorf("mode %s is not configured", name)
+		}
+		if slices.Contains(c.modes, m) {
+			return fmt.Errorf("duplicate mode: %s", name)
+		}
+		c.modes = append(c.modes, m)
 	}
-	if c.Mattermost.ServerURL != "" {
-		if c.Mattermost.AccessToken == "" {
-			return errors.New("no mattermost token specified")
+	return nil
+}
+
+// integration returns an enabled integration by name.
+func (c *appConfig) integration(name string) (apis.Integration, bool) {
+	for _, integration := range c.integrations {
+		if integration.Name() == name {
+			return integration, true
 		}
-		if c.Mattermost.TeamName == "" {
-			return errors.New("no mattermost team specified")
+	}
+	return nil, false
+}
+
+// integrationSettings returns the section of an integration or plugin in the
+// config file.
+func (c *appConfig) integrationSettings(name string) any {
+	if settings, ok := c.Plugins[name]; ok {
+		return settings
+	}
+	return c.Integrations[apis.ConfigKey(name)]
+}
+
+func (c *appConfig) loadScripts() error {
+	c.scripts = make(map[string]*script)
+	for name, settings := range c.Scripts {
+		s, err := loadScript(name, settings)
+		if err != nil {
+			return err
+		}
+		c.scripts[name] = s
+	}
+	return nil
+}
+
+func (c *appConfig) loadAnimations() error {
+	c.animations = builtinAnimations(c.profile)
+	for name, anim := range c.Animations {
+		if anim.Layer == layerBase {
+			// animations are temporary so they never belong to the base layer
+			anim.Layer = layerFeedback
 		}
-		if c.Mattermost.ChannelName == "" {
-			return errors.New("no mattermost chammel specified")
+		if err := anim.validate(c.profile); err != nil {
+			return fmt.Errorf("animation %s invalid: %v", name, err)
 		}
+		c.animations[name] = anim
 	}
-	if c.TubeRemotePort != 0 && (c.TubeRemotePort < 1024 || c.TubeRemotePort > 65535) {
-		return errors.New("invalid tuberemote port specified")
+	return nil
+}
+
+func (c *appConfig) loadBoards() error {
+	for _, board := range c.Boards {
+		if err := board.loadProfile(); err != nil {
+			return err
+		}
+	}
+	boards, err := newBoardSet(c.Boards)
+	if err != nil {
+		return fmt.Errorf("config invalid: %v", err)
+	}
+	c.boards = boards
+	c.profile = boards.profile
+	return c.profile.Require(nil, requiredLEDs)
+}
+
+func (c *appConfig) validate() error {
+	if len(c.Boards) == 0 {
+		if c.Port == "" {
+			return errors.New("no port specified")
+		}
+		c.Boards = []*boardConfig{{ID: "default", Port: c.Port, Profile: c.Profile}}
+	} else if c.Port != "" || c.Profile != "" {
+		return errors.New("port and profile must be set for each board when using boards")
+	}
+	boardIDs := make(map[string]bool)
+	for _, board := range c.Boards {
+		if board.ID == "" {
+			return errors.New("board without id specified")
+		}
+		if boardIDs[board.ID] {
+			return fmt.Errorf("duplicate board id: %s", board.ID)
+		}
+		boardIDs[board.ID] = true
+		if board.Port == "" {
+			return fmt.Errorf("no port specified for board %s", board.ID)
+		}
+		if _, err := comm.ParseTransport(board.Port); err != nil {
+			return fmt.Errorf("invalid port for board %s: %v", board.ID, err)
+		}
+	}
+	keys := apis.ConfigKeys()
+	for key := range c.Integrations {
+		if !slices.Contains(keys, key) {
+			return fmt.Errorf("unknown setting: %s", key)
+		}
+	}
+	if c.DebugPort != 0 && (c.DebugPort < 1024 || c.DebugPort > 65535) {
+		return errors.New("invalid debug port specified")
+	}
+	if c.Gestures.LongPress < 0 || c.Gestures.DoubleTap < 0 {
+		return errors.New("invalid gesture duration specified")
+	}
+	if c.Gestures.LongPress == 0 {
+		c.Gestures.LongPress = 250 * time.Millisecond
+	}
+	if c.Gestures.DoubleTap == 0 {
+		c.Gestures.DoubleTap = 250 * time.Millisecond
+	}
+	c.colors = make(map[string]comm.RGB)
+	for key, value := range c.Colors {
+		if !slices.Contains(colorKeys, key) {
+			return fmt.Errorf("unknown color: %s", key)
+		}
+		color, err := comm.ParseRGB(value)
+		if err != nil {
+			return err
+		}
+		c.colors[key] = color
 	}
 	return nil
 }
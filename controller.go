@@ -1,296 +1,383 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"os"
-	"sync"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/thiefmaster/controller/apis"
 	"github.com/thiefmaster/controller/comm"
-	"github.com/thiefmaster/controller/ddc"
-	"github.com/thiefmaster/controller/wts"
+	"github.com/thiefmaster/controller/gesture"
+	"github.com/thiefmaster/controller/hardware"
 )
 
-const (
-	knob = iota
-	buttonTopLeft
-	buttonBottomLeft
-	buttonBottomRight
-	LED5
-	LED4
-	LED3
-	LED2
-	LED1
-)
+// leds the controller needs; they are looked up by name in the hardware
+// profile. the inputs it needs depend on the keymap.
+var requiredLEDs = []string{"knob", "topLeft", "bottomLeft", "bottomRight", "LED1", "LED2", "LED3", "LED4", "LED5"}
+
+// how long to wait for the boards to be reset and closed when exiting
+const boardCloseTimeout = 2 * time.Second
 
-type buttonState struct {
-	knob             bool
-	topLeft          bool
-	bottomLeft       bool
-	bottomRight      bool
-	bottomLeftStart  time.Time
-	bottomRightStart time.Time
+// how long to wait for the integrations to stop when exiting, e.g. for plugin
+// processes to exit
+const integrationStopTimeout = 5 * time.Second
+
+// appState is owned by the main loop. Other goroutines must not touch it
+// directly but post functions to the loop instead.
+type appState struct {
+	config                *appConfig
+	profile               *hardware.Profile
+	leds                  *compositor
+	animator              *animator
+	started               bool
+	shutdown              bool
+	desktopLocked         bool
+	monitorsOn            bool
+	seeking               bool
+	seekDirection         int
+	seekDirectionErrors   int
+	disableFoobarStateLED bool
+	foobarState           apis.FoobarPlayerInfo
+	tubeRemoteState       apis.TubeRemoteState
+	notHubState           apis.NotHubState
+	mattermostState       apis.MattermostState
+	modeIndex             int
+	gestures              *gesture.Recognizer
+	events                chan func()
+	integrations          map[string]*runningIntegration
+	// cancelled once the controller shuts down
+	ctx context.Context
+	// the base layer, shared by everything showing state there so commands
+	// for the same LED cannot overtake each other
+	baseLEDs chan<- comm.Command
+	// LEDs set by scripts
+	scriptLEDs chan<- comm.Command
+	// the macro being recorded, if any
+	recording *macroRecording
+	// the name of the active behavior
+	behaviorName string
+	// do not disturb, if active
+	dnd *dndState
+	// the remaining time of DND shown while the knob is held
+	dndLEDs chan<- comm.Command
 }
 
-func (b *buttonState) handleMessage(msg comm.Message) {
-	if msg.Message != comm.ButtonPressed && msg.Message != comm.ButtonReleased {
-		return
-	}
-	pressed := msg.Message == comm.ButtonPressed
-	if msg.Source == knob {
-		b.knob = pressed
-	} else if msg.Source == buttonTopLeft {
-		b.topLeft = pressed
-	} else if msg.Source == buttonBottomLeft {
-		if !b.bottomLeft && pressed {
-			b.bottomLeftStart = time.Now()
-		} else if b.bottomLeft && !pressed {
-			b.bottomLeftStart = time.Time{}
-		}
-		b.bottomLeft = pressed
-	} else if msg.Source == buttonBottomRight {
-		if !b.bottomRight && pressed {
-			b.bottomRightStart = time.Now()
-		} else if b.bottomRight && !pressed {
-			b.bottomRightStart = time.Time{}
-		}
-		b.bottomRight = pressed
+// colorLED creates a command showing the color configured for key on an LED,
+// or the color code fallback if there is no such color.
+func (s *appState) colorLED(led, key string, fallback byte) comm.Command {
+	if color, ok := s.config.colors[key]; ok {
+		return s.profile.SetRGB(led, color)
 	}
+	return s.profile.SetLED(led, fallback)
 }
 
-func (b *buttonState) getButtonBottomLeftDuration() time.Duration {
-	if !b.bottomLeft {
-		return 0
+func (s *appState) toggleColorLED(led, key string, on bool) comm.Command {
+	if !on {
+		return s.profile.ClearLED(led)
 	}
-	return time.Now().Sub(b.bottomLeftStart)
+	return s.colorLED(led, key, '1')
 }
 
-func (b *buttonState) getButtonBottomRightDuration() time.Duration {
-	if !b.bottomRight {
-		return 0
-	}
-	return time.Now().Sub(b.bottomRightStart)
+// mode returns the active mode.
+func (s *appState) mode() mode {
+	return s.config.modes[s.modeIndex]
 }
 
-type appState struct {
-	config                    *appConfig
-	ready                     bool
-	shutdown                  bool
-	desktopLocked             bool
-	monitorsOn                bool
-	knobTurnedWhilePressed    bool
-	knobDirectionWhilePressed int
-	knobDirectionErrors       int
-	ignoreKnobRelease         bool
-	ignoreBottomLeftRelease   bool
-	ignoreBottomRightRelease  bool
-	disableFoobarStateLED     bool
-	foobarState               apis.FoobarPlayerInfo
-	tubeRemoteState           apis.TubeRemoteState
-	tubeMode                  bool
-	buttonState               buttonState
+func (s *appState) modeActive(name string) bool {
+	return s.mode().name() == name
 }
 
 func (s *appState) reset() {
-	s.ready = false
 	s.shutdown = false
 	s.desktopLocked = false
 	s.monitorsOn = true
 	s.disableFoobarStateLED = false
-	s.ignoreBottomLeftRelease = false
-	s.ignoreBottomRightRelease = false
-	s.resetKnobPressState(false)
+	s.resetSeekState()
+}
+
+// post runs f on the main loop unless ctx has been cancelled by then, e.g.
+// because the integration that posted it has been stopped.
+func (s *appState) post(ctx context.Context, f func()) {
+	select {
+	case s.events <- func() {
+		if ctx.Err() == nil {
+			f()
+		}
+	}:
+	case <-ctx.Done():
+	}
 }
 
-func (s *appState) resetKnobPressState(pressed bool) {
-	s.knobTurnedWhilePressed = false
-	s.ignoreKnobRelease = false
-	s.knobDirectionWhilePressed = 0
-	s.knobDirectionErrors = 0
+func (s *appState) resetSeekState() {
+	s.seeking = false
+	s.seekDirection = 0
+	s.seekDirectionErrors = 0
 }
 
-func trackLockedState(state *appState, cmdChan chan<- comm.Command) {
-	for locked := range wts.RunMonitor() {
-		log.Printf("desktop locked: %v\n", locked)
-		state.desktopLocked = locked
-		if !locked && state.config.Numlock {
-			apis.SetNumLock(true)
+// follow passes every value received from ch to handle on the main loop until
+// ctx is cancelled.
+func follow[T any](ctx context.Context, state *appState, ch <-chan T, handle func(T)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case value, ok := <-ch:
+			if !ok {
+				return
+			}
+			state.post(ctx, func() {
+				handle(value)
+			})
 		}
-		cmdChan <- comm.NewToggleLEDCommand(buttonTopLeft, state.desktopLocked)
 	}
 }
 
-func keepMonitorOffWhileLocked(state *appState) {
+func updateLockedState(state *appState, cmdChan chan<- comm.Command, locked bool) {
+	log.Printf("desktop locked: %v\n", locked)
+	state.desktopLocked = locked
+	cmdChan <- state.profile.ToggleLED("topLeft", state.desktopLocked)
+}
+
+func keepMonitorOffWhileLocked(ctx context.Context, state *appState, cmdChan chan<- comm.Command) {
 	// Sometimes the monitors wake up from standby even though they
 	// shouldn't. This seems to happen randomly or in some cases when
 	// connecting to the PC remotely. Let's force them back off!
-	for range time.Tick(5 * time.Second) {
-		if !state.monitorsOn && state.desktopLocked {
-			ddc.SetMonitorsStandby()
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				state.post(ctx, func() {
+					if !state.monitorsOn && state.desktopLocked {
+						runIntegrationAction(state, "ddc.standby", 0, "")
+					}
+				})
+			}
 		}
-	}
+	}()
 }
 
-func trackFoobarState(state *appState, cmdChan chan<- comm.Command) {
-	for newState := range apis.SubscribeFoobarState(state.config.Foobar) {
-		state.foobarState = newState
-		if state.knobTurnedWhilePressed {
-			continue
-		}
+func updateFoobarState(state *appState, cmdChan chan<- comm.Command, newState apis.FoobarPlayerInfo) {
+	oldState := state.foobarState
+	state.foobarState = newState
+	if state.seeking {
+		return
+	}
 
-		log.Printf("foobar state changed: playback=%s, volume=%f\n", newState.State, newState.Volume.Current)
+	log.Printf("foobar state changed: playback=%s, volume=%f\n", newState.State, newState.Volume.Current)
 
-		if state.tubeMode {
-			continue
-		}
+	if !state.modeActive("foobar") {
+		return
+	}
 
-		if newState.State == apis.FoobarStateOffline {
-			cmdChan <- comm.NewSetLEDCommand(knob, 'R')
-			time.AfterFunc(1*time.Second, func() {
-				cmdChan <- comm.NewSetLEDCommand(knob, '0')
-			})
-		} else {
-			cmdChan <- newCommandForFoobarState(state)
-		}
+	cmdChan <- state.mode().knobLED(state)
+	if newState.State == apis.FoobarStateOffline && oldState.State != apis.FoobarStateOffline {
+		// only when foobar goes away, not for every update while it is gone
+		state.animator.play("error")
 	}
 }
 
-func trackNotHubState(state *appState, cmdChan chan<- comm.Command) {
-	var nhs apis.NotHubState
-
-	go func() {
-		flag := false
-		for range time.Tick(150 * time.Millisecond) {
+// blink calls render with an alternating flag on the main loop until ctx is
+// cancelled.
+func blink(ctx context.Context, state *appState, render func(flag bool)) {
+	ticker := time.NewTicker(150 * time.Millisecond)
+	defer ticker.Stop()
+	flag := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 			flag = !flag
-			cmdChan <- comm.NewToggleLEDCommand(LED1, nhs.Commit && flag)
-			if nhs.ChanHL || nhs.PrivMsg {
-				cmdChan <- comm.NewToggleLEDCommand(LED5, flag)
-				cmdChan <- comm.NewToggleLEDCommand(LED4, !flag)
-				cmdChan <- comm.NewToggleLEDCommand(LED5, flag)
-			} else if nhs.ChanMsg {
-				cmdChan <- comm.NewToggleLEDCommand(LED5, flag)
-				cmdChan <- comm.NewClearLEDCommand(LED4)
-			} else {
-				cmdChan <- comm.NewClearLEDCommand(LED5)
-				cmdChan <- comm.NewClearLEDCommand(LED4)
-			}
+			on := flag
+			state.post(ctx, func() {
+				render(on)
+			})
 		}
-	}()
-
-	for newState := range apis.SubscribeNotHubState(state.config.NotHub) {
-		log.Printf("nothub state changed: %#v\n", newState)
-		nhs = newState
 	}
 }
 
-func trackMattermostNotifications(state *appState, cmdChan chan<- comm.Command) {
-	// notification states
-	var ns struct {
-		messages bool
-		mentions bool
-		mux      sync.Mutex
-	}
+// blinkNotHubState blinks the LEDs of the unread IRC notifications. They stay
+// off while DND is active.
+func blinkNotHubState(ctx context.Context, state *appState, cmdChan chan<- comm.Command) {
+	go blink(ctx, state, func(flag bool) {
+		nhs := state.notHubState
+		if state.dnd != nil {
+			nhs = apis.NotHubState{}
+		}
+		cmdChan <- state.toggleColorLED("LED1", "nothubCommits", nhs.Commit && flag)
+		if nhs.ChanHL || nhs.PrivMsg {
+			cmdChan <- state.toggleColorLED("LED5", "nothub", flag)
+			cmdChan <- state.toggleColorLED("LED4", "nothubHighlights", !flag)
+		} else if nhs.ChanMsg {
+			cmdChan <- state.toggleColorLED("LED5", "nothub", flag)
+			cmdChan <- state.profile.ClearLED("LED4")
+		} else {
+			cmdChan <- state.profile.ClearLED("LED5")
+			cmdChan <- state.profile.ClearLED("LED4")
+		}
+	})
+}
 
-	go func() {
-		flag := false
-		for range time.Tick(150 * time.Millisecond) {
-			flag = !flag
-			ns.mux.Lock()
-			if ns.mentions {
-				cmdChan <- comm.NewToggleLEDCommand(LED2, flag)
-				cmdChan <- comm.NewToggleLEDCommand(LED3, !flag)
-				cmdChan <- comm.NewToggleLEDCommand(LED2, flag)
-			} else if ns.messages {
-				cmdChan <- comm.NewToggleLEDCommand(LED2, flag)
-				cmdChan <- comm.NewClearLEDCommand(LED3)
-			} else {
-				cmdChan <- comm.NewClearLEDCommand(LED2)
-				cmdChan <- comm.NewClearLEDCommand(LED3)
-			}
-			ns.mux.Unlock()
+func updateNotHubState(state *appState, newState apis.NotHubState) {
+	log.Printf("nothub state changed: %#v\n", newState)
+	recordNotHubArrivals(state, newState)
+	state.notHubState = newState
+}
+
+// blinkMattermostNotifications blinks the LEDs of unread Mattermost messages
+// and mentions. They stay off while DND is active.
+func blinkMattermostNotifications(ctx context.Context, state *appState, cmdChan chan<- comm.Command) {
+	go blink(ctx, state, func(flag bool) {
+		mms := state.mattermostState
+		if state.dnd != nil {
+			mms = apis.MattermostState{}
 		}
-	}()
+		if mms.HasMentions {
+			cmdChan <- state.toggleColorLED("LED2", "mattermost", flag)
+			cmdChan <- state.toggleColorLED("LED3", "mattermostMentions", !flag)
+		} else if mms.HasMessages {
+			cmdChan <- state.toggleColorLED("LED2", "mattermost", flag)
+			cmdChan <- state.profile.ClearLED("LED3")
+		} else {
+			cmdChan <- state.profile.ClearLED("LED2")
+			cmdChan <- state.profile.ClearLED("LED3")
+		}
+	})
+}
 
-	for newState := range apis.SubscribeMattermostState(state.config.Mattermost) {
-		log.Printf("mattermost state changed: messages=%v, mentions=%v\n", newState.HasMessages, newState.HasMentions)
-		ns.mux.Lock()
-		ns.messages = newState.HasMessages
-		ns.mentions = newState.HasMentions
-		ns.mux.Unlock()
-	}
+func updateMattermostState(state *appState, newState apis.MattermostState) {
+	log.Printf("mattermost state changed: messages=%v, mentions=%v\n", newState.HasMessages, newState.HasMentions)
+	recordMattermostArrivals(state, newState)
+	state.mattermostState = newState
 }
 
-func toggleTubeMode(state *appState, cmdChan chan<- comm.Command, enabled bool) {
-	state.tubeMode = enabled
-	cmdChan <- comm.NewToggleLEDCommand(buttonBottomLeft, state.tubeMode)
-	if enabled {
-		cmdChan <- newCommandForTubeRemoteState(state)
-	} else {
-		cmdChan <- newCommandForFoobarState(state)
+func updateTubeRemoteState(state *appState, cmdChan chan<- comm.Command, newState apis.TubeRemoteState) {
+	oldState := state.tubeRemoteState
+	state.tubeRemoteState = newState
+	log.Printf("youtube state changed: %#v\n", newState)
+
+	if !state.modeActive("youtube") {
+		return
 	}
-}
 
-func switchAudioTarget(state *appState, cmdChan chan<- comm.Command) {
-	if err := apis.SetNextDefaultEndpoint(); err != nil {
-		log.Printf("Could not change default audio endpoint: %s\n", err)
+	cmdChan <- state.mode().knobLED(state)
+	if newState.ActionFailed {
+		state.animator.play("error")
+	} else if newState.State == apis.TubeRemoteStateOffline {
 		return
+	} else if ((!oldState.Playing() && newState.Playing()) || oldState.Volume > 0) && newState.Volume == 0 {
+		// show red when we just went silent or started playing while being silent
+		state.animator.play("error")
+	} else if !oldState.Offline() && oldState.Volume != 100 && newState.Volume == 100 {
+		// show green if we changed the volume to max
+		state.animator.play("success")
 	}
-	// we use `state.monitorsOn` to toggle the LED regardless of its previous state.
-	// XXX: maybe we should just prohibit most actions while the system is locked?
-	cmdChan <- comm.NewToggleLEDCommand(buttonBottomRight, state.monitorsOn)
-	time.AfterFunc(250*time.Millisecond, func() {
-		cmdChan <- comm.NewToggleLEDCommand(buttonBottomRight, !state.monitorsOn)
-	})
 }
 
-func runTubeRemote(state *appState, cmdChan chan<- comm.Command) {
-	for newState := range apis.RunTubeRemote(state.config.TubeRemotePort) {
-		oldState := state.tubeRemoteState
-		state.tubeRemoteState = newState
-		log.Printf("youtube state changed: %#v\n", newState)
-
-		if !state.tubeMode {
-			continue
+// checkProfile warns about inputs and leds in the hardware profile the board
+// does not have.
+func checkProfile(profile *hardware.Profile, caps *comm.Capabilities) {
+	for _, input := range profile.Inputs {
+		if !caps.HasInput(input.Index) {
+			log.Printf("board has no input %d (%s)\n", input.Index, input.Name)
 		}
-
-		if newState.ActionFailed {
-			cmdChan <- comm.NewSetLEDCommand(knob, 'R')
-			time.AfterFunc(1*time.Second, func() {
-				cmdChan <- newCommandForTubeRemoteState(state)
-			})
-			continue
-		} else if newState.State == apis.TubeRemoteStateOffline {
-			// if we came here right after action-failed, then changing the LED
-			// would happen too early and we have the timer to take care of it
-			if !oldState.ActionFailed {
-				cmdChan <- newCommandForTubeRemoteState(state)
-			}
-			continue
+	}
+	for _, led := range profile.LEDs {
+		if !caps.HasLED(led.Index) {
+			log.Printf("board has no led %d (%s)\n", led.Index, led.Name)
 		}
+	}
+}
 
-		if ((!oldState.Playing() && newState.Playing()) || oldState.Volume > 0) && newState.Volume == 0 {
-			// show red when we just went silent or started playing while being silent
-			cmdChan <- comm.NewSetLEDCommand(knob, 'R')
-			time.AfterFunc(1*time.Second, func() {
-				cmdChan <- newCommandForTubeRemoteState(state)
-			})
-		} else if !oldState.Offline() && oldState.Volume != 100 && newState.Volume == 100 {
-			// show green if we changed the volume to max
-			cmdChan <- comm.NewSetLEDCommand(knob, 'G')
-			time.AfterFunc(1*time.Second, func() {
-				cmdChan <- newCommandForTubeRemoteState(state)
-			})
-		} else {
-			cmdChan <- newCommandForTubeRemoteState(state)
+// handleMessage handles a message from one of the boards and returns the
+// gestures it completes.
+func handleMessage(ctx context.Context, state *appState, boards *boardSet, cmdChan chan<- comm.Command, msg comm.Message) []gesture.Event {
+	board := boards.board(msg.Board)
+	switch msg.Message {
+	case comm.Connected:
+		log.Printf("rotaryboard %s connected, waiting for it to become ready\n", board.config.ID)
+	case comm.Disconnected:
+		log.Printf("rotaryboard %s disconnected\n", board.config.ID)
+		board.ready = false
+		for _, name := range boards.inputNames(board.config.ID) {
+			state.gestures.Release(name)
+		}
+		state.resetSeekState()
+	case comm.Hello:
+		log.Printf("rotaryboard %s handshake: %s\n", board.config.ID, msg.Capabilities)
+	case comm.Ready:
+		board.capabilities = msg.Capabilities
+		checkProfile(board.config.profile, msg.Capabilities)
+		if state.started && !board.ready {
+			log.Printf("rotaryboard %s ready, restoring leds\n", board.config.ID)
+			board.ready = true
+			renderAllLEDs(state, cmdChan)
+		} else if !board.ready {
+			board.ready = true
+			state.started = true
+			startIntegrations(ctx, state, cmdChan)
+		}
+	default:
+		if !board.ready {
+			log.Printf("ignoring input from rotaryboard %s during setup\n", board.config.ID)
+			return nil
+		}
+		input := state.profile.InputName(msg.Source)
+		events := state.gestures.Handle(input, msg)
+		if input == "knob" && msg.Message == comm.ButtonPressed {
+			showDNDRemaining(state)
+		} else if input == "knob" && msg.Message == comm.ButtonReleased && state.dnd != nil {
+			hideDNDRemaining(state)
 		}
+		if msg.Message == comm.ButtonReleased && state.seeking && !state.gestures.AnyPressed() {
+			// seeking is over so the player state can be shown again
+			state.resetSeekState()
+			cmdChan <- state.mode().knobLED(state)
+		}
+		return events
+	}
+	return nil
+}
+
+// startIntegrations shows the intro and starts tracking the state of all
+// configured integrations once the first board is ready.
+func startIntegrations(ctx context.Context, state *appState, cmdChan chan<- comm.Command) {
+	showFancyIntro(state, cmdChan)
+	updateIntegrations(ctx, state)
+}
+
+func gestureConfig(config *appConfig) gesture.Config {
+	return gesture.Config{
+		LongPress: config.Gestures.LongPress,
+		DoubleTap: config.Gestures.DoubleTap,
+		Chords:    config.keymap.chords(),
+		Wants:     config.keymap.has,
 	}
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs the controller until it is shut down and returns the exit status.
+func run() int {
+	recordPath := flag.String("record", "", "record all rotaryboard traffic to this file")
+	replayPath := flag.String("replay", "", "replay rotaryboard input from a recording instead of using the board")
+	replaySpeed := flag.Float64("speed", 1, "replay speed factor (0 to replay without delays)")
+	flag.Parse()
+
 	configPath := "config.yaml"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	if flag.NArg() > 0 {
+		configPath = flag.Arg(0)
 	}
 
 	config := &appConfig{}
@@ -298,128 +385,138 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	state := &appState{config: config}
+	state := &appState{
+		config:       config,
+		profile:      config.profile,
+		events:       make(chan func(), 16),
+		integrations: make(map[string]*runningIntegration),
+	}
+	state.gestures = gesture.New(gestureConfig(config), gesture.RealClock)
 	state.reset()
 
-	msgChan, cmdChan := comm.OpenPort(config.Port)
-
-	for msg := range msgChan {
-		if state.ready {
-			state.buttonState.handleMessage(msg)
-		}
-		switch {
-		case msg.Message == comm.Ready:
-			if !state.ready {
-				state.ready = true
-				go showFancyIntro(cmdChan, 75*time.Millisecond)
-				go trackLockedState(state, cmdChan)
-				go keepMonitorOffWhileLocked(state)
-				go trackFoobarState(state, cmdChan)
-				if config.NotHub.BaseURL != "" {
-					go trackNotHubState(state, cmdChan)
-				}
-				if config.Mattermost.ServerURL != "" {
-					go trackMattermostNotifications(state, cmdChan)
-				}
-				if config.TubeRemotePort != 0 {
-					go runTubeRemote(state, cmdChan)
-				}
-			}
-		case !state.ready:
-			log.Println("ignoring input during setup")
-		case msg.Message == comm.ButtonReleased && msg.Source == buttonTopLeft:
-			lockDesktop(state)
-		case msg.Message == comm.ButtonReleased && msg.Source == buttonBottomRight:
-			if !state.ignoreBottomRightRelease {
-				toggleMonitors(cmdChan, state)
-			}
-			state.ignoreBottomRightRelease = false
-		case msg.Message == comm.ButtonPressed && msg.Source == buttonBottomRight:
-			time.AfterFunc(250*time.Millisecond, func() {
-				if !state.shutdown && state.buttonState.getButtonBottomRightDuration() > 250*time.Millisecond {
-					state.ignoreBottomRightRelease = true
-					switchAudioTarget(state, cmdChan)
-				}
-			})
-		case msg.Message == comm.ButtonReleased && msg.Source == buttonBottomLeft:
-			if !state.buttonState.knob && !state.ignoreBottomLeftRelease {
-				if state.tubeMode {
-					toggleTubeMode(state, cmdChan, false)
-				} else {
-					go foobarNext(state, cmdChan)
-				}
+	// the boards stay connected while everything else shuts down so they can
+	// show the outro
+	boardCtx, closeBoards := context.WithCancel(context.Background())
+	defer closeBoards()
+	boards := config.boards
+	if (*replayPath != "" || *recordPath != "") && len(boards.boards) > 1 {
+		log.Fatalln("recording and replaying is only supported with a single board")
+	}
+	for _, b := range boards.boards {
+		if *replayPath != "" {
+			f, err := os.Open(*replayPath)
+			if err != nil {
+				log.Fatalln(err)
 			}
-			state.ignoreBottomLeftRelease = false
-		case msg.Message == comm.ButtonPressed && msg.Source == buttonBottomLeft:
-			if state.buttonState.knob {
-				state.ignoreKnobRelease = true
-				state.ignoreBottomLeftRelease = true
-				if state.tubeMode {
-					go tubeRemoteStop(cmdChan)
-				} else {
-					go foobarStop(state, cmdChan)
-				}
-			} else if !state.tubeMode && config.TubeRemotePort != 0 {
-				time.AfterFunc(250*time.Millisecond, func() {
-					if !state.shutdown && state.buttonState.getButtonBottomLeftDuration() > 250*time.Millisecond {
-						state.ignoreBottomLeftRelease = true
-						toggleTubeMode(state, cmdChan, true)
-					}
-				})
+			if b.msgChan, b.cmdChan, err = comm.Replay(boardCtx, f, *replaySpeed); err != nil {
+				log.Fatalln(err)
 			}
-		case msg.Message == comm.ButtonPressed && msg.Source == knob:
-			state.resetKnobPressState(true)
-		case msg.Message == comm.ButtonReleased && msg.Source == knob:
-			if state.tubeMode {
-				if !state.knobTurnedWhilePressed && !state.ignoreKnobRelease {
-					go tubeRemoteTogglePause()
-				}
-			} else {
-				if !state.knobTurnedWhilePressed && !state.ignoreKnobRelease {
-					go foobarTogglePause(state)
-				}
-				state.resetKnobPressState(false)
-				cmdChan <- newCommandForFoobarState(state)
+			f.Close()
+		} else {
+			transport, err := comm.ParseTransport(b.config.Port)
+			if err != nil {
+				log.Fatalln(err)
 			}
-		case msg.Message == comm.KnobTurned && msg.Source == knob:
-			if state.buttonState.knob {
-				if !state.knobTurnedWhilePressed {
-					log.Println("knob turning while pressed")
-					state.knobDirectionWhilePressed = signum(msg.Value)
-					state.knobTurnedWhilePressed = true
-				}
-				if state.knobDirectionWhilePressed != signum(msg.Value) {
-					log.Println("turn direction not maching initial direction")
-					state.knobDirectionErrors++
-					if state.knobDirectionErrors > 5 {
-						cmdChan <- comm.NewSetLEDCommand(knob, 'R')
-						time.AfterFunc(150*time.Millisecond, func() {
-							cmdChan <- comm.NewSetLEDCommand(knob, '0')
-						})
-					}
-				} else {
-					if state.tubeMode {
-						go tubeRemoteSeek(msg.Value)
-					} else {
-						go foobarSeek(state, msg.Value)
-					}
-				}
-			} else {
-				if state.tubeMode {
-					go tubeRemoteAdjustVolume(msg.Value)
-				} else {
-					go foobarAdjustVolume(state, cmdChan, msg.Value)
-				}
+			b.msgChan, b.cmdChan = comm.OpenPort(boardCtx, transport)
+		}
+		if *recordPath != "" {
+			f, err := os.Create(*recordPath)
+			if err != nil {
+				log.Fatalln(err)
 			}
+			defer f.Close()
+			log.Printf("recording rotaryboard traffic to %s\n", *recordPath)
+			b.msgChan, b.cmdChan = comm.Record(f, b.msgChan, b.cmdChan)
 		}
-
-		if state.buttonState.topLeft && state.buttonState.bottomLeft && state.buttonState.bottomRight {
+	}
+	msgChan, boardCmdChan := boards.open()
+
+	state.leds = newCompositor(state.profile, boardCmdChan)
+	state.animator = newAnimator(state.leds, config.animations)
+	cmdChan := state.leds.channel(layerBase, "controller")
+	state.baseLEDs = cmdChan
+	state.scriptLEDs = state.leds.channel(layerNotification, "scripts")
+	state.dndLEDs = state.leds.channel(layerAlert, "dnd")
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	ctx, cancel := context.WithCancel(signalCtx)
+	defer cancel()
+	state.ctx = ctx
+	if config.DebugPort != 0 {
+		go runDebugServer(ctx, state, config.DebugPort)
+	}
+	go watchConfig(ctx, state, cmdChan, configPath)
+	updateBehavior(ctx, state)
+	go runSchedule(ctx, state)
+
+	for !state.shutdown {
+		var events []gesture.Event
+		// wake up when a pending gesture such as a long-press completes
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if deadline, ok := state.gestures.Deadline(); ok {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("received signal, shutting down")
 			state.shutdown = true
-			log.Println("shutdown requested")
-			break
+		case <-timeout:
+			events = state.gestures.Expire()
+		case f := <-state.events:
+			f()
+		case msg, ok := <-msgChan:
+			if !ok {
+				state.shutdown = true
+				break
+			}
+			events = handleMessage(ctx, state, boards, cmdChan, msg)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		for _, event := range events {
+			forwardGesture(state, event)
+			for _, name := range state.config.keymap.actions(event) {
+				log.Printf("%s %s: %s\n", strings.Join(event.Inputs, "+"), event.Kind, name)
+				// the keymap only contains actions that exist in its config
+				a, _ := state.config.findAction(name)
+				a.run(state, cmdChan, event.Value)
+			}
 		}
 	}
 
-	showFancyOutro(cmdChan)
+	// a second signal kills the controller right away
+	stopSignals()
+	cancel()
+	status := 0
+	if !stopIntegrations(state, integrationStopTimeout) {
+		status = 1
+	}
+	showFancyOutro(state)
+	closeBoards()
+	if !waitForBoards(msgChan, boardCloseTimeout) {
+		log.Println("boards did not close in time")
+		return 1
+	}
 	log.Println("exiting")
+	return status
+}
+
+// waitForBoards discards messages until all boards have been closed.
+func waitForBoards(msgChan <-chan comm.Message, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-msgChan:
+			if !ok {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
 }
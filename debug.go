@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/thiefmaster/controller/apis"
+)
+
+type integrationStatus struct {
+	Name   string      `json:"name"`
+	Health apis.Health `json:"health"`
+	State  any         `json:"state"`
+}
+
+// runDebugServer serves information about the controller's internal state on
+// localhost until ctx is cancelled.
+func runDebugServer(ctx context.Context, state *appState, port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/leds", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state.leds.ownership()); err != nil {
+			log.Printf("could not write debug response: %v\n", err)
+		}
+	})
+	mux.HandleFunc("/integrations", func(w http.ResponseWriter, r *http.Request) {
+		// the running integrations belong to the main loop
+		reply := make(chan []integrationStatus, 1)
+		state.post(r.Context(), func() {
+			reply <- integrationStatuses(state)
+		})
+		var statuses []integrationStatus
+		select {
+		case statuses = <-reply:
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			log.Printf("could not write debug response: %v\n", err)
+		}
+	})
+	server := &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", port), Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("debug server exited: %v\n", err)
+	}
+}
+
+func integrationStatuses(state *appState) []integrationStatus {
+	statuses := []integrationStatus{}
+	for name, running := range state.integrations {
+		statuses = append(statuses, integrationStatus{
+			Name:   name,
+			Health: running.integration.Health(),
+			State:  running.integration.State(),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/thiefmaster/controller/apis"
+)
+
+type dndSettings struct {
+	// how long DND lasts unless it is ended before; 0 means until it is ended
+	Duration time.Duration
+	// whether to set the Mattermost status to do not disturb as well
+	MattermostStatus bool `yaml:"mattermostStatus"`
+}
+
+// dndState is the state while do not disturb is active. The Mattermost and
+// nothub LEDs stay off until it ends.
+type dndState struct {
+	started time.Time
+	// zero if DND does not expire
+	until  time.Time
+	cancel context.CancelFunc
+	// how many notifications arrived while DND was active
+	mattermostMessages int
+	mattermostMentions int
+	notHubMessages     int
+	notHubHighlights   int
+	notHubCommits      int
+}
+
+func (c *appConfig) loadDND() error {
+	if c.DND.Duration < 0 {
+		return errors.New("invalid dnd duration specified")
+	}
+	if _, ok := c.integration("mattermost"); c.DND.MattermostStatus && !ok {
+		return errors.New("dnd: mattermostStatus needs the mattermost integration")
+	}
+	return nil
+}
+
+// toggleDND starts or ends do not disturb.
+func toggleDND(state *appState) {
+	if state.dnd != nil {
+		endDND(state)
+		return
+	}
+	settings := state.config.DND
+	dnd := &dndState{started: time.Now()}
+	var dndCtx context.Context
+	if settings.Duration > 0 {
+		dnd.until = dnd.started.Add(settings.Duration)
+		dndCtx, dnd.cancel = context.WithDeadline(state.ctx, dnd.until)
+		log.Printf("do not disturb until %s\n", dnd.until.Format("15:04"))
+	} else {
+		dndCtx, dnd.cancel = context.WithCancel(state.ctx)
+		log.Println("do not disturb")
+	}
+	state.dnd = dnd
+	if settings.MattermostStatus {
+		runIntegrationAction(state, "mattermost.dnd", int(settings.Duration/time.Minute), "")
+	}
+	go func() {
+		<-dndCtx.Done()
+		if errors.Is(dndCtx.Err(), context.DeadlineExceeded) {
+			// posted with the parent context since dndCtx is done already
+			state.post(state.ctx, func() {
+				if state.dnd == dnd {
+					log.Println("do not disturb expired")
+					endDND(state)
+				}
+			})
+		}
+	}()
+}
+
+// endDND shows the notifications again and what arrived in the meantime.
+func endDND(state *appState) {
+	dnd := state.dnd
+	dnd.cancel()
+	state.dnd = nil
+	log.Printf("do not disturb ended after %v\n", time.Since(dnd.started).Round(time.Second))
+	hideDNDRemaining(state)
+	if state.config.DND.MattermostStatus {
+		runIntegrationAction(state, "mattermost.online", 0, "")
+	}
+	showDNDSummary(state, dnd)
+}
+
+// recordMattermostArrivals counts the posts and mentions which arrived while
+// DND is active.
+func recordMattermostArrivals(state *appState, newState apis.MattermostState) {
+	dnd := state.dnd
+	if dnd == nil {
+		return
+	}
+	dnd.mattermostMessages += arrivals(state.mattermostState.Posts, newState.Posts)
+	dnd.mattermostMentions += arrivals(state.mattermostState.Mentions, newState.Mentions)
+}
+
+// arrivals returns how often a counter of the Mattermost integration was
+// increased. It starts from zero again when the integration is restarted.
+func arrivals(oldCount, newCount int) int {
+	if newCount < oldCount {
+		return newCount
+	}
+	return newCount - oldCount
+}
+
+// recordNotHubArrivals counts the IRC notifications which arrived while DND is
+// active. nothub sends its whole state with every notification, so each kind
+// which is set counts, unless the update only happened because some were
+// read.
+func recordNotHubArrivals(state *appState, newState apis.NotHubState) {
+	dnd := state.dnd
+	if dnd == nil {
+		return
+	}
+	old := state.notHubState
+	if (old.ChanMsg && !newState.ChanMsg) || (old.ChanHL && !newState.ChanHL) ||
+		(old.PrivMsg && !newState.PrivMsg) || (old.Commit && !newState.Commit) {
+		return
+	}
+	if newState.ChanMsg {
+		dnd.notHubMessages++
+	}
+	if newState.ChanHL || newState.PrivMsg {
+		dnd.notHubHighlights++
+	}
+	if newState.Commit {
+		dnd.notHubCommits++
+	}
+}
+
+// showDNDSummary blinks the LEDs of the notifications which arrived while DND
+// was active, using the same LEDs and colors as the notification blinkers.
+func showDNDSummary(state *appState, dnd *dndState) {
+	arrived := []struct {
+		count    int
+		led, key string
+	}{
+		{dnd.notHubCommits, "LED1", "nothubCommits"},
+		{dnd.mattermostMessages, "LED2", "mattermost"},
+		{dnd.mattermostMentions, "LED3", "mattermostMentions"},
+		{dnd.notHubHighlights, "LED4", "nothubHighlights"},
+		{dnd.notHubMessages, "LED5", "nothub"},
+	}
+	var on, off []keyframe
+	for _, a := range arrived {
+		if a.count == 0 {
+			continue
+		}
+		log.Printf("%d %s notifications arrived while not disturbed\n", a.count, a.key)
+		color := "1"
+		if rgb, ok := state.config.colors[a.key]; ok {
+			color = rgb.String()
+		}
+		on = append(on, keyframe{LED: a.led, Color: color})
+		off = append(off, keyframe{LED: a.led, Color: "0"})
+	}
+	if len(on) == 0 {
+		log.Println("nothing arrived while not disturbed")
+		state.animator.play("success")
+		return
+	}
+	on[len(on)-1].Duration = 300 * time.Millisecond
+	off[len(off)-1].Duration = 200 * time.Millisecond
+	state.animator.start("dndSummary", animation{Repeat: 3, Layer: layerFeedback, Frames: append(on, off...)})
+}
+
+// showDNDRemaining shows the remaining time of DND on the LED bar while the
+// knob is held: the more time is left, the more LEDs are lit.
+func showDNDRemaining(state *appState) {
+	dnd := state.dnd
+	if dnd == nil {
+		return
+	}
+	bar := state.profile.Bar()
+	lit := len(bar)
+	if !dnd.until.IsZero() {
+		remaining := time.Until(dnd.until)
+		log.Printf("do not disturb for another %v\n", remaining.Round(time.Minute))
+		// round up so the bar is only empty once DND has expired
+		total := dnd.until.Sub(dnd.started)
+		lit = int((remaining*time.Duration(len(bar)) + total - 1) / total)
+	}
+	for i, led := range bar {
+		if i < lit {
+			state.dndLEDs <- state.profile.SetLED(led, 'G')
+		} else {
+			state.dndLEDs <- state.profile.ClearLED(led)
+		}
+	}
+}
+
+func hideDNDRemaining(state *appState) {
+	for _, led := range state.profile.Bar() {
+		state.dndLEDs <- state.profile.ClearLED(led)
+	}
+}
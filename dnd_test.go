@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thiefmaster/controller/apis"
+	"github.com/thiefmaster/controller/comm"
+	"github.com/thiefmaster/controller/gesture"
+	"github.com/thiefmaster/controller/hardware"
+)
+
+func TestRecordMattermostArrivals(t *testing.T) {
+	state := &appState{dnd: &dndState{}}
+	updates := []apis.MattermostState{
+		{HasMessages: true, Posts: 1},
+		// further posts count even though there were unread ones already
+		{HasMessages: true, Posts: 2},
+		{HasMessages: true, HasMentions: true, Posts: 3, Mentions: 1},
+		// reading the posts does not count
+		{Posts: 3, Mentions: 1},
+		// the counters start from zero when the integration is restarted
+		{HasMessages: true, Posts: 1},
+	}
+	for _, update := range updates {
+		recordMattermostArrivals(state, update)
+		state.mattermostState = update
+	}
+	if state.dnd.mattermostMessages != 4 || state.dnd.mattermostMentions != 1 {
+		t.Errorf("got %d messages and %d mentions, want 4 and 1", state.dnd.mattermostMessages, state.dnd.mattermostMentions)
+	}
+}
+
+func TestRecordNotHubArrivals(t *testing.T) {
+	state := &appState{dnd: &dndState{}}
+	updates := []apis.NotHubState{
+		{ChanMsg: true},
+		{ChanMsg: true},
+		{ChanMsg: true, PrivMsg: true},
+		{ChanMsg: true, PrivMsg: true, Commit: true},
+		// reading the private message does not count
+		{ChanMsg: true, Commit: true},
+		{},
+	}
+	for _, update := range updates {
+		recordNotHubArrivals(state, update)
+		state.notHubState = update
+	}
+	dnd := state.dnd
+	if dnd.notHubMessages != 4 || dnd.notHubHighlights != 2 || dnd.notHubCommits != 1 {
+		t.Errorf("got %d messages, %d highlights and %d commits, want 4, 2 and 1",
+			dnd.notHubMessages, dnd.notHubHighlights, dnd.notHubCommits)
+	}
+}
+
+// TestDNDRemaining checks that the remaining time of DND is shown while the
+// knob is held.
+func TestDNDRemaining(t *testing.T) {
+	profile := hardware.Default()
+	knob, _ := profile.Input(hardware.InputKnob)
+	dndLEDs := make(chan comm.Command, 16)
+	state := &appState{
+		profile:  profile,
+		gestures: gesture.New(gesture.Config{LongPress: time.Second, DoubleTap: time.Second}, gesture.RealClock),
+		dndLEDs:  dndLEDs,
+	}
+	boards := &boardSet{boards: []*board{{config: &boardConfig{ID: "main"}, ready: true}}, profile: profile}
+	press := func(message comm.Message) {
+		message.Source = knob.Index
+		message.Board = "main"
+		handleMessage(context.Background(), state, boards, nil, message)
+	}
+	// how many LEDs of the bar are lit, or -1 if nothing was sent
+	lit := func() int {
+		select {
+		case cmd := <-dndLEDs:
+			count := 0
+			for i := range profile.Bar() {
+				if i > 0 {
+					cmd = <-dndLEDs
+				}
+				if cmd.Color() != '0' {
+					count++
+				}
+			}
+			return count
+		default:
+			return -1
+		}
+	}
+
+	// without DND the knob does not show anything
+	press(comm.Message{Message: comm.ButtonPressed})
+	press(comm.Message{Message: comm.ButtonReleased})
+	if n := lit(); n != -1 {
+		t.Fatalf("got %d leds lit without DND", n)
+	}
+
+	now := time.Now()
+	state.dnd = &dndState{started: now.Add(-30 * time.Minute), until: now.Add(30 * time.Minute)}
+	press(comm.Message{Message: comm.ButtonPressed})
+	if n := lit(); n != (len(profile.Bar())+1)/2 {
+		t.Errorf("got %d leds lit with half of DND remaining", n)
+	}
+	press(comm.Message{Message: comm.ButtonReleased})
+	if n := lit(); n != 0 {
+		t.Errorf("got %d leds lit after releasing the knob, want 0", n)
+	}
+
+	// DND without a duration lights up the whole bar
+	state.dnd = &dndState{started: now}
+	press(comm.Message{Message: comm.ButtonPressed})
+	if n := lit(); n != len(profile.Bar()) {
+		t.Errorf("got %d leds lit for DND without a duration", n)
+	}
+	press(comm.Message{Message: comm.ButtonReleased})
+	if n := lit(); n != 0 {
+		t.Errorf("got %d leds lit after releasing the knob, want 0", n)
+	}
+}
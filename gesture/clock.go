@@ -0,0 +1,44 @@
+package gesture
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the recognizer the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// RealClock is the system clock.
+var RealClock Clock = realClock{}
+
+// ManualClock is a clock that only moves when told to, e.g. to replay input
+// or to test gestures without depending on timing.
+type ManualClock struct {
+	now time.Time
+	mux sync.Mutex
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	c.now = c.now.Add(d)
+	c.mux.Unlock()
+}
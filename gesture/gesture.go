@@ -0,0 +1,247 @@
+// Package gesture turns the button and knob messages of a rotaryboard into
+// high-level gestures such as taps, long-presses and chords.
+//
+// The recognizer is synchronous and does not start any timers: its owner
+// passes messages to Handle and calls Expire once the time returned by
+// Deadline has been reached. Together with a ManualClock this makes gestures
+// fully deterministic.
+package gesture
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/thiefmaster/controller/comm"
+)
+
+type Kind string
+
+const (
+	// Press is sent whenever a button is pressed.
+	Press Kind = "press"
+	// Tap is a short press and release.
+	Tap Kind = "tap"
+	// DoubleTap is two taps in quick succession.
+	DoubleTap Kind = "doubleTap"
+	// LongPress is sent while a button has been held long enough.
+	LongPress Kind = "longPress"
+	// LongRelease is the release after a long-press.
+	LongRelease Kind = "longRelease"
+	// Turn is turning a knob.
+	Turn Kind = "turn"
+	// HoldTurn is turning a knob while a button (or the knob itself) is held.
+	HoldTurn Kind = "holdTurn"
+	// Chord is pressing several buttons at the same time.
+	Chord Kind = "chord"
+)
+
+var Kinds = []Kind{Press, Tap, DoubleTap, LongPress, LongRelease, Turn, HoldTurn, Chord}
+
+type Event struct {
+	Kind Kind
+	// Inputs contains a single input except for chords, where it contains the
+	// inputs in the order the chord was defined.
+	Inputs []string
+	// Value is the number of steps a knob was turned.
+	Value int
+}
+
+type Config struct {
+	// LongPress is how long a button has to be held for a long-press.
+	LongPress time.Duration
+	// DoubleTap is how long to wait for a second tap.
+	DoubleTap time.Duration
+	// Chords lists the input combinations that form chords.
+	Chords [][]string
+	// Wants tells whether a gesture on an input is used. Gestures nobody wants
+	// do not delay or swallow others: e.g. without a double-tap a tap is sent
+	// right away, and without a long-press holding a button still ends in a
+	// tap.
+	Wants func(kind Kind, input string) bool
+}
+
+type button struct {
+	pressedAt   time.Time
+	longPressed bool
+	// set when the button is part of a chord or hold-and-turn, so its
+	// release is not a gesture of its own
+	consumed bool
+	// set when the button was pressed again shortly after a tap
+	secondTap bool
+}
+
+type Recognizer struct {
+	config  Config
+	clock   Clock
+	pressed map[string]*button
+	// taps waiting for a possible second tap, by release time
+	pendingTaps map[string]time.Time
+}
+
+func New(config Config, clock Clock) *Recognizer {
+	return &Recognizer{
+		config:      config,
+		clock:       clock,
+		pressed:     make(map[string]*button),
+		pendingTaps: make(map[string]time.Time),
+	}
+}
+
+// SetConfig replaces the config, e.g. once the keymap has changed. Inputs that
+// are held keep their state, so releasing them completes their gestures.
+func (r *Recognizer) SetConfig(config Config) {
+	r.config = config
+}
+
+func (r *Recognizer) wants(kind Kind, input string) bool {
+	return r.config.Wants != nil && r.config.Wants(kind, input)
+}
+
+// wantsLongPress tells whether holding an input needs to be detected.
+func (r *Recognizer) wantsLongPress(input string) bool {
+	return r.wants(LongPress, input) || r.wants(LongRelease, input)
+}
+
+func (r *Recognizer) IsPressed(input string) bool {
+	_, ok := r.pressed[input]
+	return ok
+}
+
+// AnyPressed tells whether any button is held.
+func (r *Recognizer) AnyPressed() bool {
+	return len(r.pressed) > 0
+}
+
+// Handle processes a message for an input and returns the gestures that are
+// complete now, including those that expired before the message.
+func (r *Recognizer) Handle(input string, msg comm.Message) []Event {
+	now := r.clock.Now()
+	events := r.expire(now)
+	if input == "" {
+		return events
+	}
+	switch msg.Message {
+	case comm.ButtonPressed:
+		if r.IsPressed(input) {
+			break
+		}
+		b := &button{pressedAt: now}
+		if _, ok := r.pendingTaps[input]; ok {
+			delete(r.pendingTaps, input)
+			b.secondTap = true
+		}
+		r.pressed[input] = b
+		events = append(events, Event{Kind: Press, Inputs: []string{input}})
+		for _, chord := range r.config.Chords {
+			if slices.Contains(chord, input) && r.allPressed(chord) {
+				events = append(events, Event{Kind: Chord, Inputs: chord})
+				for _, chordInput := range chord {
+					r.pressed[chordInput].consumed = true
+				}
+			}
+		}
+	case comm.ButtonReleased:
+		b, ok := r.pressed[input]
+		if !ok {
+			break
+		}
+		delete(r.pressed, input)
+		switch {
+		case b.consumed:
+		case b.longPressed:
+			events = append(events, Event{Kind: LongRelease, Inputs: []string{input}})
+		case b.secondTap:
+			events = append(events, Event{Kind: DoubleTap, Inputs: []string{input}})
+		case r.wants(DoubleTap, input):
+			r.pendingTaps[input] = now
+		default:
+			events = append(events, Event{Kind: Tap, Inputs: []string{input}})
+		}
+	case comm.KnobTurned:
+		// turning a pressed knob takes precedence over other held buttons
+		held := append([]string{input}, sortedKeys(r.pressed)...)
+		for _, name := range held {
+			if b, ok := r.pressed[name]; ok && r.wants(HoldTurn, name) {
+				b.consumed = true
+				return append(events, Event{Kind: HoldTurn, Inputs: []string{name}, Value: msg.Value})
+			}
+		}
+		events = append(events, Event{Kind: Turn, Inputs: []string{input}, Value: msg.Value})
+	}
+	return events
+}
+
+// Expire returns the gestures that completed because time has passed, i.e.
+// long-presses and taps that did not become double-taps.
+func (r *Recognizer) Expire() []Event {
+	return r.expire(r.clock.Now())
+}
+
+func (r *Recognizer) expire(now time.Time) []Event {
+	var events []Event
+	for _, input := range sortedKeys(r.pressed) {
+		b := r.pressed[input]
+		if r.waitsForLongPress(input, b) && !now.Before(b.pressedAt.Add(r.config.LongPress)) {
+			b.longPressed = true
+			events = append(events, Event{Kind: LongPress, Inputs: []string{input}})
+		}
+	}
+	for _, input := range sortedKeys(r.pendingTaps) {
+		if !now.Before(r.pendingTaps[input].Add(r.config.DoubleTap)) {
+			delete(r.pendingTaps, input)
+			events = append(events, Event{Kind: Tap, Inputs: []string{input}})
+		}
+	}
+	return events
+}
+
+func (r *Recognizer) waitsForLongPress(input string, b *button) bool {
+	return !b.longPressed && !b.consumed && r.wantsLongPress(input)
+}
+
+// Deadline returns when Expire should be called next, if at all.
+func (r *Recognizer) Deadline() (time.Time, bool) {
+	var deadline time.Time
+	found := false
+	update := func(t time.Time) {
+		if !found || t.Before(deadline) {
+			deadline = t
+			found = true
+		}
+	}
+	for input, b := range r.pressed {
+		if r.waitsForLongPress(input, b) {
+			update(b.pressedAt.Add(r.config.LongPress))
+		}
+	}
+	for _, releasedAt := range r.pendingTaps {
+		update(releasedAt.Add(r.config.DoubleTap))
+	}
+	return deadline, found
+}
+
+// Release forgets that an input is pressed without sending any gestures, e.g.
+// because its board has been disconnected.
+func (r *Recognizer) Release(input string) {
+	delete(r.pressed, input)
+	delete(r.pendingTaps, input)
+}
+
+func (r *Recognizer) allPressed(inputs []string) bool {
+	for _, input := range inputs {
+		if !r.IsPressed(input) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,271 @@
+package gesture
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thiefmaster/controller/comm"
+)
+
+const (
+	longPress = 250 * time.Millisecond
+	doubleTap = 200 * time.Millisecond
+)
+
+// step is something that happens to the recognizer: a message for an input,
+// or time passing (input is empty) after which Expire is called.
+type step struct {
+	input string
+	msg   comm.Message
+	wait  time.Duration
+}
+
+func press(input string) step {
+	return step{input: input, msg: comm.Message{Message: comm.ButtonPressed}}
+}
+
+func release(input string) step {
+	return step{input: input, msg: comm.Message{Message: comm.ButtonReleased}}
+}
+
+func turn(input string, value int) step {
+	return step{input: input, msg: comm.Message{Message: comm.KnobTurned, Value: value}}
+}
+
+func wait(d time.Duration) step {
+	return step{wait: d}
+}
+
+func event(kind Kind, value int, inputs ...string) Event {
+	return Event{Kind: kind, Inputs: inputs, Value: value}
+}
+
+func TestRecognizer(t *testing.T) {
+	tests := []struct {
+		name   string
+		wants  []string
+		chords [][]string
+		steps  []step
+		events []Event
+	}{
+		{
+			name:   "tap",
+			wants:  []string{"tap knob"},
+			steps:  []step{press("knob"), wait(100 * time.Millisecond), release("knob")},
+			events: []Event{event(Press, 0, "knob"), event(Tap, 0, "knob")},
+		},
+		{
+			name:   "held tap without long-press",
+			wants:  []string{"tap knob"},
+			steps:  []step{press("knob"), wait(time.Second), release("knob")},
+			events: []Event{event(Press, 0, "knob"), event(Tap, 0, "knob")},
+		},
+		{
+			name:  "double-tap",
+			wants: []string{"tap knob", "doubleTap knob"},
+			steps: []step{
+				press("knob"), release("knob"), wait(100 * time.Millisecond),
+				press("knob"), release("knob"),
+			},
+			events: []Event{event(Press, 0, "knob"), event(Press, 0, "knob"), event(DoubleTap, 0, "knob")},
+		},
+		{
+			name:   "tap delayed by double-tap",
+			wants:  []string{"tap knob", "doubleTap knob"},
+			steps:  []step{press("knob"), release("knob"), wait(doubleTap)},
+			events: []Event{event(Press, 0, "knob"), event(Tap, 0, "knob")},
+		},
+		{
+			name:  "two taps too far apart",
+			wants: []string{"tap knob", "doubleTap knob"},
+			steps: []step{
+				press("knob"), release("knob"), wait(doubleTap),
+				press("knob"), release("knob"), wait(doubleTap),
+			},
+			events: []Event{
+				event(Press, 0, "knob"), event(Tap, 0, "knob"),
+				event(Press, 0, "knob"), event(Tap, 0, "knob"),
+			},
+		},
+		{
+			name:   "long-press and long-release",
+			wants:  []string{"longPress topLeft", "longRelease topLeft"},
+			steps:  []step{press("topLeft"), wait(longPress), release("topLeft")},
+			events: []Event{event(Press, 0, "topLeft"), event(LongPress, 0, "topLeft"), event(LongRelease, 0, "topLeft")},
+		},
+		{
+			name:   "short press with long-press bound",
+			wants:  []string{"tap topLeft", "longPress topLeft"},
+			steps:  []step{press("topLeft"), wait(longPress - time.Millisecond), release("topLeft")},
+			events: []Event{event(Press, 0, "topLeft"), event(Tap, 0, "topLeft")},
+		},
+		{
+			name:   "turn",
+			steps:  []step{turn("knob", -2)},
+			events: []Event{event(Turn, -2, "knob")},
+		},
+		{
+			name:  "hold-turn consumes the release",
+			wants: []string{"tap knob", "holdTurn knob"},
+			steps: []step{press("knob"), turn("knob", 3), release("knob")},
+			events: []Event{
+				event(Press, 0, "knob"), event(HoldTurn, 3, "knob"),
+			},
+		},
+		{
+			name:  "hold-turn on another held button",
+			wants: []string{"holdTurn bottomLeft"},
+			steps: []step{press("bottomLeft"), turn("knob", 1), release("bottomLeft")},
+			events: []Event{
+				event(Press, 0, "bottomLeft"), event(HoldTurn, 1, "bottomLeft"),
+			},
+		},
+		{
+			name:   "turn while held without hold-turn",
+			wants:  []string{"tap knob"},
+			steps:  []step{press("knob"), turn("knob", 1), release("knob")},
+			events: []Event{event(Press, 0, "knob"), event(Turn, 1, "knob"), event(Tap, 0, "knob")},
+		},
+		{
+			name:   "chord consumes its inputs",
+			wants:  []string{"tap knob", "tap bottomLeft", "longPress knob"},
+			chords: [][]string{{"knob", "bottomLeft"}},
+			steps: []step{
+				press("bottomLeft"), press("knob"), wait(longPress),
+				release("knob"), release("bottomLeft"),
+			},
+			events: []Event{
+				event(Press, 0, "bottomLeft"), event(Press, 0, "knob"),
+				event(Chord, 0, "knob", "bottomLeft"),
+			},
+		},
+		{
+			name:   "incomplete chord",
+			wants:  []string{"tap knob"},
+			chords: [][]string{{"knob", "bottomLeft"}},
+			steps:  []step{press("knob"), release("knob")},
+			events: []Event{event(Press, 0, "knob"), event(Tap, 0, "knob")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewManualClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+			r := New(Config{
+				LongPress: longPress,
+				DoubleTap: doubleTap,
+				Chords:    tt.chords,
+				Wants: func(kind Kind, input string) bool {
+					for _, want := range tt.wants {
+						if want == string(kind)+" "+input {
+							return true
+						}
+					}
+					return false
+				},
+			}, clock)
+			var events []Event
+			for _, s := range tt.steps {
+				if s.input == "" {
+					clock.Advance(s.wait)
+					events = append(events, r.Expire()...)
+				} else {
+					events = append(events, r.Handle(s.input, s.msg)...)
+				}
+			}
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Errorf("got events %v, want %v", events, tt.events)
+			}
+			if r.AnyPressed() {
+				t.Error("inputs still pressed after the last step")
+			}
+		})
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	r := New(Config{
+		LongPress: longPress,
+		DoubleTap: doubleTap,
+		Wants: func(kind Kind, input string) bool {
+			return (kind == LongPress && input == "topLeft") || (kind == DoubleTap && input == "knob")
+		},
+	}, clock)
+
+	if _, ok := r.Deadline(); ok {
+		t.Fatal("deadline without pending gestures")
+	}
+
+	r.Handle("topLeft", comm.Message{Message: comm.ButtonPressed})
+	if deadline, ok := r.Deadline(); !ok || !deadline.Equal(start.Add(longPress)) {
+		t.Fatalf("got deadline %v, %v, want the long-press", deadline, ok)
+	}
+
+	// the pending tap expires before the long-press
+	clock.Advance(10 * time.Millisecond)
+	r.Handle("knob", comm.Message{Message: comm.ButtonPressed})
+	r.Handle("knob", comm.Message{Message: comm.ButtonReleased})
+	if deadline, ok := r.Deadline(); !ok || !deadline.Equal(start.Add(10*time.Millisecond+doubleTap)) {
+		t.Fatalf("got deadline %v, %v, want the pending tap", deadline, ok)
+	}
+
+	if events := r.Expire(); len(events) != 0 {
+		t.Fatalf("got events %v before the deadline", events)
+	}
+	clock.Advance(doubleTap)
+	if events := r.Expire(); !reflect.DeepEqual(events, []Event{event(Tap, 0, "knob")}) {
+		t.Fatalf("got events %v, want the tap", events)
+	}
+	if deadline, ok := r.Deadline(); !ok || !deadline.Equal(start.Add(longPress)) {
+		t.Fatalf("got deadline %v, %v, want the long-press", deadline, ok)
+	}
+
+	clock.Advance(longPress)
+	if events := r.Expire(); !reflect.DeepEqual(events, []Event{event(LongPress, 0, "topLeft")}) {
+		t.Fatalf("got events %v, want the long-press", events)
+	}
+	// a long-press is only sent once
+	if _, ok := r.Deadline(); ok {
+		t.Fatal("deadline after the long-press")
+	}
+	if events := r.Expire(); len(events) != 0 {
+		t.Fatalf("got events %v after the long-press", events)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	config := Config{
+		LongPress: longPress,
+		DoubleTap: doubleTap,
+		Wants: func(kind Kind, input string) bool {
+			return kind == Tap
+		},
+	}
+	r := New(config, clock)
+	r.Handle("knob", comm.Message{Message: comm.ButtonPressed})
+	r.Handle("topLeft", comm.Message{Message: comm.ButtonPressed})
+
+	// the held inputs are released with the new config
+	config.LongPress = 2 * longPress
+	config.Wants = func(kind Kind, input string) bool {
+		return kind == Tap || (kind == LongPress && input == "topLeft")
+	}
+	r.SetConfig(config)
+	if !r.IsPressed("knob") || !r.IsPressed("topLeft") {
+		t.Fatal("held inputs forgotten")
+	}
+	clock.Advance(longPress)
+	if events := r.Expire(); len(events) != 0 {
+		t.Fatalf("got events %v before the new long-press duration", events)
+	}
+	clock.Advance(longPress)
+	if events := r.Expire(); !reflect.DeepEqual(events, []Event{event(LongPress, 0, "topLeft")}) {
+		t.Fatalf("got events %v, want the long-press", events)
+	}
+	if events := r.Handle("knob", comm.Message{Message: comm.ButtonReleased}); !reflect.DeepEqual(events, []Event{event(Tap, 0, "knob")}) {
+		t.Fatalf("got events %v, want the tap", events)
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/moutend/go-wca v0.3.0
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	github.com/thiefmaster/eventsource v0.0.0-20190112161129-b1ba234fd8fc
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
 	golang.org/x/sys v0.14.0
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,244 @@
+// Package hardware describes the layout of a rotaryboard: which inputs and
+// LEDs it has, their protocol indexes and the colors each LED supports.
+package hardware
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/thiefmaster/controller/comm"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	InputButton = "button"
+	InputKnob   = "knob"
+)
+
+//go:embed rotaryboard.yaml
+var defaultProfile []byte
+
+type Input struct {
+	Name  string
+	Index int
+	// Kind is either "button" (the default) or "knob"; knobs can be pressed
+	// and turned.
+	Kind string
+}
+
+type LED struct {
+	Name  string
+	Index int
+	// Colors lists the supported color codes; `#` stands for arbitrary RGB
+	// colors.
+	Colors string
+	// Bar marks LEDs that are part of the LED bar; they are listed in the
+	// order they appear on the board.
+	Bar bool
+}
+
+type Profile struct {
+	Name   string
+	Inputs []Input
+	LEDs   []LED `yaml:"leds"`
+}
+
+// Default returns the built-in profile of the original rotaryboard.
+func Default() *Profile {
+	p, err := parse(defaultProfile)
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in profile: %v", err))
+	}
+	return p
+}
+
+// Load reads a profile from a YAML file.
+func Load(path string) (*Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open hardware profile: %v", err)
+	}
+	p, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("hardware profile %s invalid: %v", path, err)
+	}
+	return p, nil
+}
+
+func parse(data []byte) (*Profile, error) {
+	p := &Profile{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, err
+	}
+	for i := range p.Inputs {
+		if p.Inputs[i].Kind == "" {
+			p.Inputs[i].Kind = InputButton
+		}
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Profile) validate() error {
+	if len(p.Inputs) == 0 && len(p.LEDs) == 0 {
+		return errors.New("no inputs or leds defined")
+	}
+	inputNames := make(map[string]bool)
+	inputIndexes := make(map[int]bool)
+	for _, input := range p.Inputs {
+		if input.Name == "" {
+			return fmt.Errorf("input %d has no name", input.Index)
+		}
+		if inputNames[input.Name] {
+			return fmt.Errorf("duplicate input name: %s", input.Name)
+		}
+		if inputIndexes[input.Index] {
+			return fmt.Errorf("duplicate input index: %d", input.Index)
+		}
+		if input.Kind != InputButton && input.Kind != InputKnob {
+			return fmt.Errorf("input %s has invalid kind: %s", input.Name, input.Kind)
+		}
+		inputNames[input.Name] = true
+		inputIndexes[input.Index] = true
+	}
+	ledNames := make(map[string]bool)
+	ledIndexes := make(map[int]bool)
+	for _, led := range p.LEDs {
+		if led.Name == "" {
+			return fmt.Errorf("led %d has no name", led.Index)
+		}
+		if ledNames[led.Name] {
+			return fmt.Errorf("duplicate led name: %s", led.Name)
+		}
+		if ledIndexes[led.Index] {
+			return fmt.Errorf("duplicate led index: %d", led.Index)
+		}
+		if led.Colors == "" {
+			return fmt.Errorf("led %s supports no colors", led.Name)
+		}
+		if strings.Trim(led.Colors, "RGY1#") != "" {
+			return fmt.Errorf("led %s has unknown colors: %s", led.Name, led.Colors)
+		}
+		ledNames[led.Name] = true
+		ledIndexes[led.Index] = true
+	}
+	return nil
+}
+
+// Require checks that the profile has all the given inputs and LEDs.
+func (p *Profile) Require(inputs, leds []string) error {
+	for _, name := range inputs {
+		if _, ok := p.Input(name); !ok {
+			return fmt.Errorf("hardware profile %s has no input %s", p.Name, name)
+		}
+	}
+	for _, name := range leds {
+		if _, ok := p.LED(name); !ok {
+			return fmt.Errorf("hardware profile %s has no led %s", p.Name, name)
+		}
+	}
+	return nil
+}
+
+func (p *Profile) Input(name string) (Input, bool) {
+	for _, input := range p.Inputs {
+		if input.Name == name {
+			return input, true
+		}
+	}
+	return Input{}, false
+}
+
+// InputName returns the name of the input with the given protocol index, or
+// an empty string if there is no such input.
+func (p *Profile) InputName(index int) string {
+	for _, input := range p.Inputs {
+		if input.Index == index {
+			return input.Name
+		}
+	}
+	return ""
+}
+
+func (p *Profile) LED(name string) (LED, bool) {
+	for _, led := range p.LEDs {
+		if led.Name == name {
+			return led, true
+		}
+	}
+	return LED{}, false
+}
+
+// Bar returns the names of the LEDs in the LED bar.
+func (p *Profile) Bar() []string {
+	var names []string
+	for _, led := range p.LEDs {
+		if led.Bar {
+			names = append(names, led.Name)
+		}
+	}
+	return names
+}
+
+// ButtonLEDs returns the names of all LEDs that are not part of the LED bar.
+func (p *Profile) ButtonLEDs() []string {
+	var names []string
+	for _, led := range p.LEDs {
+		if !led.Bar {
+			names = append(names, led.Name)
+		}
+	}
+	return names
+}
+
+// SetLED creates a command to show a color on an LED. LEDs that do not
+// support the color show its RGB equivalent or the first color they support
+// instead.
+func (p *Profile) SetLED(name string, color byte) comm.Command {
+	led, ok := p.LED(name)
+	if !ok {
+		panic(fmt.Sprintf("unknown led: %s", name))
+	}
+	if color == '0' {
+		return comm.NewClearLEDCommand(led.Index)
+	} else if strings.IndexByte(led.Colors, color) == -1 {
+		if rgb, ok := comm.LegacyColor(color); ok && strings.IndexByte(led.Colors, '#') != -1 {
+			return comm.NewSetRGBLEDCommand(led.Index, rgb)
+		}
+		if fallback := strings.Trim(led.Colors, "#"); fallback != "" {
+			color = fallback[0]
+		}
+	}
+	return comm.NewSetLEDCommand(led.Index, color)
+}
+
+// SetRGB creates a command to show an RGB color on an LED. Boards without RGB
+// support show the nearest color the LED supports.
+func (p *Profile) SetRGB(name string, color comm.RGB) comm.Command {
+	led, ok := p.LED(name)
+	if !ok {
+		panic(fmt.Sprintf("unknown led: %s", name))
+	}
+	return comm.NewSetRGBLEDCommand(led.Index, color)
+}
+
+func (p *Profile) ClearLED(name string) comm.Command {
+	led, ok := p.LED(name)
+	if !ok {
+		panic(fmt.Sprintf("unknown led: %s", name))
+	}
+	return comm.NewClearLEDCommand(led.Index)
+}
+
+func (p *Profile) ToggleLED(name string, on bool) comm.Command {
+	if on {
+		return p.SetLED(name, '1')
+	} else {
+		return p.ClearLED(name)
+	}
+}
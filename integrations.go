@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/thiefmaster/controller/apis"
+	"github.com/thiefmaster/controller/comm"
+	"github.com/thiefmaster/controller/gesture"
+)
+
+// view shows the state of an integration on the board. Integrations without a
+// view still run, so their actions can be used.
+type view struct {
+	// views on the base layer share it with the controller
+	layer ledLayer
+	// start is called on the main loop when the integration is started, e.g.
+	// to run blinkers. everything it starts has to stop once ctx is cancelled.
+	start func(ctx context.Context, state *appState, cmdChan chan<- comm.Command)
+	// update is called on the main loop whenever the state changes
+	update func(state *appState, cmdChan chan<- comm.Command, value any)
+}
+
+var views = map[string]view{
+	"lock": {layer: layerBase, start: keepMonitorOffWhileLocked, update: func(state *appState, cmdChan chan<- comm.Command, value any) {
+		updateLockedState(state, cmdChan, value.(bool))
+	}},
+	"ddc": {layer: layerBase, update: func(state *appState, cmdChan chan<- comm.Command, value any) {
+		updateMonitorsState(state, cmdChan, value.(bool))
+	}},
+	"foobar": {layer: layerBase, update: func(state *appState, cmdChan chan<- comm.Command, value any) {
+		updateFoobarState(state, cmdChan, value.(apis.FoobarPlayerInfo))
+	}},
+	"nothub": {layer: layerNotification, start: blinkNotHubState, update: func(state *appState, cmdChan chan<- comm.Command, value any) {
+		updateNotHubState(state, value.(apis.NotHubState))
+	}},
+	"mattermost": {layer: layerNotification, start: blinkMattermostNotifications, update: func(state *appState, cmdChan chan<- comm.Command, value any) {
+		updateMattermostState(state, value.(apis.MattermostState))
+	}},
+	"tuberemote": {layer: layerBase, update: func(state *appState, cmdChan chan<- comm.Command, value any) {
+		updateTubeRemoteState(state, cmdChan, value.(apis.TubeRemoteState))
+	}},
+}
+
+// pluginView shows the LEDs of a plugin. They are shown like notifications so
+// they do not hide the player state when the plugin turns them off.
+func pluginView(name string) view {
+	return view{layer: layerNotification, update: func(state *appState, cmdChan chan<- comm.Command, value any) {
+		updatePluginState(state, cmdChan, name, value.(apis.PluginState))
+	}}
+}
+
+func updatePluginState(state *appState, cmdChan chan<- comm.Command, name string, newState apis.PluginState) {
+	for led, color := range newState.LEDs {
+		if _, ok := state.profile.LED(led); !ok {
+			log.Printf("plugin %s uses unknown led: %s\n", name, led)
+			continue
+		}
+		if err := validateFrameColor(color); err != nil || color == "toggle" {
+			log.Printf("plugin %s uses invalid color for %s: %s\n", name, led, color)
+			continue
+		}
+		cmdChan <- ledCommand(state.profile, led, color)
+	}
+}
+
+type runningIntegration struct {
+	integration apis.Integration
+	settings    any
+	ctx         context.Context
+	cancel      context.CancelFunc
+	cmdChan     chan<- comm.Command
+}
+
+// updateIntegrations starts the integrations enabled in the current config and
+// behavior and stops or restarts the running ones whose settings changed.
+func updateIntegrations(ctx context.Context, state *appState) {
+	for name, running := range state.integrations {
+		if !state.integrationEnabled(name) || !reflect.DeepEqual(running.settings, state.config.integrationSettings(name)) {
+			stopIntegration(state, name)
+		}
+	}
+	for _, integration := range state.config.integrations {
+		_, running := state.integrations[integration.Name()]
+		if !running && state.integrationEnabled(integration.Name()) {
+			startIntegration(ctx, state, integration)
+		}
+	}
+}
+
+func startIntegration(ctx context.Context, state *appState, integration apis.Integration) {
+	name := integration.Name()
+	log.Printf("starting %s integration\n", name)
+	v := views[name]
+	if _, ok := state.config.Plugins[name]; ok {
+		v = pluginView(name)
+	}
+	integrationCtx, cancel := context.WithCancel(ctx)
+	cmdChan := state.baseLEDs
+	if v.layer != layerBase {
+		cmdChan = state.leds.channel(v.layer, name)
+	}
+	state.integrations[name] = &runningIntegration{
+		integration: integration,
+		settings:    state.config.integrationSettings(name),
+		ctx:         integrationCtx,
+		cancel:      cancel,
+		cmdChan:     cmdChan,
+	}
+	if v.start != nil {
+		v.start(integrationCtx, state, cmdChan)
+	}
+	go follow(integrationCtx, state, integration.Start(integrationCtx), func(value any) {
+		if v.update != nil {
+			v.update(state, cmdChan, value)
+		}
+	})
+}
+
+func stopIntegration(state *appState, name string) {
+	log.Printf("stopping %s integration\n", name)
+	running := state.integrations[name]
+	running.cancel()
+	// releases the LEDs claimed by the integration. the base layer is shared
+	// and rendered from the state, so it is left alone.
+	if running.cmdChan != state.baseLEDs {
+		close(running.cmdChan)
+	}
+	delete(state.integrations, name)
+}
+
+// stopIntegrations stops all running integrations and waits until they have
+// stopped or timeout is over. It returns false if some did not stop in time.
+func stopIntegrations(state *appState, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var stopping []apis.Integration
+	for name, running := range state.integrations {
+		stopping = append(stopping, running.integration)
+		stopIntegration(state, name)
+	}
+	stopped := true
+	for _, integration := range stopping {
+		if err := integration.Wait(ctx); err != nil {
+			log.Printf("%s integration did not stop in time\n", integration.Name())
+			stopped = false
+		}
+	}
+	return stopped
+}
+
+// integrationAction looks up an action of an enabled integration, e.g.
+// `foobar.next`.
+func integrationAction(config *appConfig, name string) (apis.Action, bool) {
+	integrationName, actionName, ok := strings.Cut(name, ".")
+	if !ok {
+		return apis.Action{}, false
+	}
+	integration, ok := config.integration(integrationName)
+	if !ok {
+		return apis.Action{}, false
+	}
+	return apis.FindAction(integration, actionName)
+}
+
+// findRunningAction looks up an action like `foobar.next` of a running
+// integration.
+func findRunningAction(state *appState, name string) (apis.Action, *runningIntegration, bool) {
+	integrationName, actionName, _ := strings.Cut(name, ".")
+	running := state.integrations[integrationName]
+	if running == nil {
+		log.Printf("cannot run %s: %s is not running\n", name, integrationName)
+		return apis.Action{}, nil, false
+	}
+	action, ok := apis.FindAction(running.integration, actionName)
+	if !ok {
+		log.Printf("unknown action: %s\n", name)
+		return apis.Action{}, nil, false
+	}
+	return action, running, true
+}
+
+// runIntegrationAction runs an action like `foobar.next` of a running
+// integration in the background and plays an animation once it succeeded, or
+// when a turn action hit the end of its range. If a macro is being recorded,
+// the action or the one reproducing its outcome is added to it.
+func runIntegrationAction(state *appState, name string, value int, animation string) {
+	integrationName, _, _ := strings.Cut(name, ".")
+	action, running, ok := findRunningAction(state, name)
+	if !ok {
+		return
+	}
+	ctx := apis.WithLimit(running.ctx, func(upper bool) {
+		// show red at the minimum and green at the maximum
+		if upper {
+			state.animator.play("success")
+		} else {
+			state.animator.play("error")
+		}
+	})
+	step := state.recordStep(name, value)
+	var result *macroStep
+	if step != nil {
+		ctx = apis.WithResult(ctx, func(action string, value int) {
+			result = &macroStep{Action: integrationName + "." + action, Value: value}
+		})
+	}
+	go func() {
+		err := action.Run(ctx, value)
+		if step != nil {
+			state.post(running.ctx, func() {
+				if err != nil {
+					step.failed = true
+				} else if result != nil {
+					*step = *result
+				}
+			})
+		}
+		if err != nil {
+			log.Printf("%s failed: %v\n", name, err)
+			return
+		}
+		if animation != "" {
+			state.animator.play(animation)
+		}
+	}()
+}
+
+// forwardGesture passes a gesture to the running integrations that want to
+// know about all gestures, e.g. plugins.
+func forwardGesture(state *appState, event gesture.Event) {
+	g := apis.Gesture{Inputs: event.Inputs, Kind: string(event.Kind), Value: event.Value}
+	for _, running := range state.integrations {
+		if listener, ok := running.integration.(apis.GestureListener); ok {
+			listener.HandleGesture(g)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/thiefmaster/controller/gesture"
+	"github.com/thiefmaster/controller/hardware"
+)
+
+// binding runs an action when a gesture is performed on some inputs.
+type binding struct {
+	inputs  []string
+	gesture gesture.Kind
+	action  string
+}
+
+func (b binding) involves(input string) bool {
+	return slices.Contains(b.inputs, input)
+}
+
+func (b binding) matches(event gesture.Event) bool {
+	return b.gesture == event.Kind && slices.Equal(b.inputs, event.Inputs)
+}
+
+func (b binding) String() string {
+	return fmt.Sprintf("%s %s", strings.Join(b.inputs, "+"), b.gesture)
+}
+
+type keymap []binding
+
+// the bindings used unless they are overridden in the `keymap` section of the
+// config file. holding topLeft shows the behavior and still locks the desktop
+// once it is released.
+var defaultKeymap = map[string]string{
+	"topLeft tap":                          "lockDesktop",
+	"topLeft longPress":                    "showBehavior",
+	"topLeft longRelease":                  "lockDesktop",
+	"bottomRight tap":                      "toggleMonitors",
+	"bottomRight longPress":                "switchAudioTarget",
+	"bottomLeft tap":                       "next",
+	"bottomLeft longPress":                 "cycleMode",
+	"knob+bottomLeft chord":                "stop",
+	"knob tap":                             "togglePause",
+	"knob turn":                            "volume",
+	"knob holdTurn":                        "seek",
+	"topLeft+bottomLeft+bottomRight chord": "shutdown",
+}
+
+// noAction removes a default binding
+const noAction = "none"
+
+// loadKeymap combines the default keymap with the bindings from the config
+// file and validates the result.
+func loadKeymap(profile *hardware.Profile, overrides map[string]string, findAction func(name string) (action, bool)) (keymap, error) {
+	combined := make(map[string]string)
+	for key, action := range defaultKeymap {
+		combined[key] = action
+	}
+	for key, action := range overrides {
+		combined[key] = action
+	}
+	var km keymap
+	for key, action := range combined {
+		if action == noAction {
+			continue
+		}
+		b, err := parseBinding(profile, findAction, key, action)
+		if err != nil {
+			return nil, err
+		}
+		km = append(km, b)
+	}
+	// sorted so chords and holds are resolved the same way on every start
+	sort.Slice(km, func(i, j int) bool {
+		return km[i].String() < km[j].String()
+	})
+	return km, nil
+}
+
+// parseBinding parses a binding like `knob+bottomLeft chord: stop`.
+func parseBinding(profile *hardware.Profile, findAction func(name string) (action, bool), key, actionName string) (binding, error) {
+	inputSpec, gestureSpec, ok := strings.Cut(key, " ")
+	if !ok {
+		return binding{}, fmt.Errorf("invalid binding %q: expected `<input> <gesture>`", key)
+	}
+	b := binding{inputs: strings.Split(inputSpec, "+"), gesture: gesture.Kind(gestureSpec), action: actionName}
+	if !slices.Contains(gesture.Kinds, b.gesture) {
+		return binding{}, fmt.Errorf("invalid binding %q: unknown gesture %s", key, gestureSpec)
+	}
+	for _, name := range b.inputs {
+		input, ok := profile.Input(name)
+		if !ok {
+			return binding{}, fmt.Errorf("invalid binding %q: unknown input %s", key, name)
+		}
+		if b.gesture == gesture.Turn && input.Kind != hardware.InputKnob {
+			return binding{}, fmt.Errorf("invalid binding %q: %s is not a knob", key, name)
+		}
+	}
+	if b.gesture == gesture.Chord {
+		if len(b.inputs) < 2 {
+			return binding{}, fmt.Errorf("invalid binding %q: chords need at least two inputs", key)
+		}
+	} else if len(b.inputs) != 1 {
+		return binding{}, fmt.Errorf("invalid binding %q: only chords can use several inputs", key)
+	}
+	action, ok := findAction(actionName)
+	if !ok {
+		return binding{}, fmt.Errorf("invalid binding %q: unknown action %s", key, actionName)
+	}
+	isTurn := b.gesture == gesture.Turn || b.gesture == gesture.HoldTurn
+	if action.any {
+		return b, nil
+	} else if action.turn && !isTurn {
+		return binding{}, fmt.Errorf("invalid binding %q: %s can only be bound to turn gestures", key, actionName)
+	} else if !action.turn && isTurn {
+		return binding{}, fmt.Errorf("invalid binding %q: %s cannot be bound to turn gestures", key, actionName)
+	}
+	return b, nil
+}
+
+// has tells whether a gesture on an input is bound to an action.
+func (k keymap) has(kind gesture.Kind, input string) bool {
+	for _, b := range k {
+		if b.gesture == kind && b.involves(input) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k keymap) chords() [][]string {
+	var chords [][]string
+	for _, b := range k {
+		if b.gesture == gesture.Chord {
+			chords = append(chords, b.inputs)
+		}
+	}
+	return chords
+}
+
+// actions returns the names of the actions bound to a gesture.
+func (k keymap) actions(event gesture.Event) []string {
+	var names []string
+	for _, b := range k {
+		if b.matches(event) {
+			names = append(names, b.action)
+		}
+	}
+	return names
+}
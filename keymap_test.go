@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/thiefmaster/controller/gesture"
+	"github.com/thiefmaster/controller/hardware"
+)
+
+// testActions finds the actions used by the keymap tests.
+func testActions(name string) (action, bool) {
+	a, ok := map[string]action{
+		"next":   {},
+		"volume": {turn: true},
+		"script": {any: true},
+	}[name]
+	return a, ok
+}
+
+func TestParseBinding(t *testing.T) {
+	tests := []struct {
+		key, action string
+		want        binding
+		wantErr     bool
+	}{
+		{key: "bottomLeft tap", action: "next", want: binding{inputs: []string{"bottomLeft"}, gesture: gesture.Tap, action: "next"}},
+		{key: "knob turn", action: "volume", want: binding{inputs: []string{"knob"}, gesture: gesture.Turn, action: "volume"}},
+		{key: "knob holdTurn", action: "volume", want: binding{inputs: []string{"knob"}, gesture: gesture.HoldTurn, action: "volume"}},
+		{
+			key: "knob+bottomLeft chord", action: "next",
+			want: binding{inputs: []string{"knob", "bottomLeft"}, gesture: gesture.Chord, action: "next"},
+		},
+		{key: "bottomLeft doubleTap", action: "script", want: binding{inputs: []string{"bottomLeft"}, gesture: gesture.DoubleTap, action: "script"}},
+		{key: "knob turn", action: "script", want: binding{inputs: []string{"knob"}, gesture: gesture.Turn, action: "script"}},
+		{key: "bottomLeft", action: "next", wantErr: true},
+		{key: "bottomLeft wiggle", action: "next", wantErr: true},
+		{key: "middle tap", action: "next", wantErr: true},
+		{key: "bottomLeft turn", action: "volume", wantErr: true},
+		{key: "knob chord", action: "next", wantErr: true},
+		{key: "knob+bottomLeft tap", action: "next", wantErr: true},
+		{key: "knob+middle chord", action: "next", wantErr: true},
+		{key: "bottomLeft tap", action: "explode", wantErr: true},
+		{key: "bottomLeft tap", action: "volume", wantErr: true},
+		{key: "knob turn", action: "next", wantErr: true},
+	}
+	profile := hardware.Default()
+	for _, tt := range tests {
+		got, err := parseBinding(profile, testActions, tt.key, tt.action)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: %s: got %v, want an error", tt.key, tt.action, got)
+			}
+		} else if err != nil || !slices.Equal(got.inputs, tt.want.inputs) || got.gesture != tt.want.gesture || got.action != tt.want.action {
+			t.Errorf("%s: %s: got %v, %v, want %v", tt.key, tt.action, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadKeymap(t *testing.T) {
+	// every action exists; volume and seek are turn actions
+	findAction := func(name string) (action, bool) {
+		return action{turn: name == "volume" || name == "seek"}, true
+	}
+	km, err := loadKeymap(hardware.Default(), map[string]string{
+		"bottomLeft tap":        "toggleMonitors",
+		"knob+bottomLeft chord": noAction,
+	}, findAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		event gesture.Event
+		want  []string
+	}{
+		// overridden
+		{gesture.Event{Kind: gesture.Tap, Inputs: []string{"bottomLeft"}}, []string{"toggleMonitors"}},
+		// removed
+		{gesture.Event{Kind: gesture.Chord, Inputs: []string{"knob", "bottomLeft"}}, nil},
+		// kept from the default keymap
+		{gesture.Event{Kind: gesture.Turn, Inputs: []string{"knob"}}, []string{"volume"}},
+		{gesture.Event{Kind: gesture.DoubleTap, Inputs: []string{"knob"}}, nil},
+	}
+	for _, tt := range tests {
+		if got := km.actions(tt.event); !slices.Equal(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.event, got, tt.want)
+		}
+	}
+	if !km.has(gesture.LongPress, "topLeft") || km.has(gesture.DoubleTap, "topLeft") {
+		t.Error("got the wrong gestures for topLeft")
+	}
+	if chords := km.chords(); len(chords) != 1 {
+		t.Errorf("got chords %v, want only the shutdown chord", chords)
+	}
+
+	// invalid overrides are reported
+	if _, err := loadKeymap(hardware.Default(), map[string]string{"knob tap": "volume"}, findAction); err == nil {
+		t.Error("got no error for a turn action bound to a tap")
+	}
+}
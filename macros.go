@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/thiefmaster/controller/comm"
+	"gopkg.in/yaml.v2"
+)
+
+// where macros are saved unless the config file specifies a different file
+const defaultMacroFile = "macros.yaml"
+
+// macroStep is an action run while recording a macro. Integration actions whose
+// outcome depends on the state, like changing the volume, are recorded as an
+// action that reproduces their outcome, like setting the volume.
+type macroStep struct {
+	Action string `yaml:"action"`
+	Value  int    `yaml:"value,omitempty"`
+	failed bool
+}
+
+type macroRecording struct {
+	name  string
+	steps []*macroStep
+}
+
+// recordStep adds an action to the macro being recorded. It returns nil if no
+// macro is being recorded.
+func (s *appState) recordStep(action string, value int) *macroStep {
+	if s.recording == nil {
+		return nil
+	}
+	step := &macroStep{Action: action, Value: value}
+	s.recording.steps = append(s.recording.steps, step)
+	return step
+}
+
+// toggleMacroRecording starts recording a macro or saves the one being
+// recorded. Starting to record another macro saves the current one first.
+func toggleMacroRecording(state *appState, name string) {
+	if rec := state.recording; rec != nil {
+		state.recording = nil
+		// actions still running now are saved as they were run
+		var steps []macroStep
+		for _, step := range rec.steps {
+			if !step.failed {
+				steps = append(steps, *step)
+			}
+		}
+		if len(steps) == 0 {
+			log.Printf("nothing recorded for macro %s\n", rec.name)
+			state.animator.play("warning")
+		} else {
+			log.Printf("saving macro %s with %d actions\n", rec.name, len(steps))
+			path := state.config.Macros
+			go func() {
+				if err := saveMacro(path, rec.name, steps); err != nil {
+					log.Printf("could not save macro %s: %v\n", rec.name, err)
+					state.animator.play("error")
+					return
+				}
+				state.animator.play("success")
+			}()
+		}
+		if rec.name == name {
+			return
+		}
+	}
+	log.Printf("recording macro %s\n", name)
+	state.recording = &macroRecording{name: name}
+	state.animator.play("recordMacro")
+}
+
+// playMacro runs the actions of a saved macro in the order they were recorded.
+// Integration actions run one after another in the background, each waiting
+// for the previous one to finish.
+func playMacro(state *appState, cmdChan chan<- comm.Command, name string) {
+	path := state.config.Macros
+	go func() {
+		macros, err := loadMacros(path)
+		if err != nil {
+			log.Printf("could not load macros: %v\n", err)
+			state.animator.play("error")
+			return
+		}
+		steps, ok := macros[name]
+		if !ok {
+			log.Printf("unknown macro: %s\n", name)
+			state.animator.play("error")
+			return
+		}
+		log.Printf("playing macro %s\n", name)
+		for _, step := range steps {
+			var run func() error
+			done := make(chan struct{})
+			state.post(state.ctx, func() {
+				defer close(done)
+				run = startMacroStep(state, cmdChan, name, step)
+			})
+			select {
+			case <-done:
+			case <-state.ctx.Done():
+				return
+			}
+			if run == nil {
+				continue
+			}
+			if err := run(); err != nil {
+				log.Printf("%s failed: %v\n", step.Action, err)
+			}
+		}
+	}()
+}
+
+// startMacroStep runs a step of a macro on the main loop. For integration
+// actions it returns a function running the action instead, which the caller
+// waits for before the next step.
+func startMacroStep(state *appState, cmdChan chan<- comm.Command, name string, step macroStep) func() error {
+	// the config may have changed since the macro was recorded
+	a, ok := state.config.findAction(step.Action)
+	if !ok {
+		log.Printf("skipping unknown action in macro %s: %s\n", name, step.Action)
+		return nil
+	}
+	if _, ok := integrationAction(state.config, step.Action); !ok {
+		a.run(state, cmdChan, step.Value)
+		return nil
+	}
+	action, running, ok := findRunningAction(state, step.Action)
+	if !ok {
+		return nil
+	}
+	// recorded steps already reproduce their outcome
+	recorded := state.recordStep(step.Action, step.Value)
+	return func() error {
+		err := action.Run(running.ctx, step.Value)
+		if err != nil && recorded != nil {
+			state.post(running.ctx, func() {
+				recorded.failed = true
+			})
+		}
+		return err
+	}
+}
+
+// guards the macro file
+var macroFileMux sync.Mutex
+
+func loadMacros(path string) (map[string][]macroStep, error) {
+	macroFileMux.Lock()
+	defer macroFileMux.Unlock()
+	return readMacroFile(path)
+}
+
+func readMacroFile(path string) (map[string][]macroStep, error) {
+	macros := make(map[string][]macroStep)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return macros, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, &macros); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	return macros, nil
+}
+
+// saveMacro adds a macro to the macro file or replaces the one with the same
+// name.
+func saveMacro(path, name string, steps []macroStep) error {
+	macroFileMux.Lock()
+	defer macroFileMux.Unlock()
+	macros, err := readMacroFile(path)
+	if err != nil {
+		return err
+	}
+	macros[name] = steps
+	data, err := yaml.Marshal(macros)
+	if err != nil {
+		return err
+	}
+	// replace the file at once so a crash cannot leave half of it behind
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
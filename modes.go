@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+
+	"github.com/thiefmaster/controller/comm"
+)
+
+// mode is a player controlled by the knob. Only one mode is active at a time
+// but all of them keep tracking the state of their player.
+type mode interface {
+	// name is used in the `modes` section of the config file and as the key
+	// of the mode's color
+	name() string
+	// enabled tells whether the mode can be used with a config
+	enabled(config *appConfig) bool
+	togglePause(state *appState)
+	stop(state *appState)
+	next(state *appState, cmdChan chan<- comm.Command)
+	adjustVolume(state *appState, delta int)
+	seek(state *appState, delta int)
+	// knobLED returns the command showing the player state on the knob
+	knobLED(state *appState) comm.Command
+}
+
+// all modes in the order they are used unless the `modes` section of the
+// config file specifies a different one
+var availableModes = []mode{foobarMode{}, tubeRemoteMode{}}
+
+func findMode(name string) (mode, bool) {
+	for _, m := range availableModes {
+		if m.name() == name {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+type foobarMode struct{}
+
+func (foobarMode) name() string {
+	return "foobar"
+}
+
+func (foobarMode) enabled(config *appConfig) bool {
+	_, ok := config.integration("foobar")
+	return ok
+}
+
+func (foobarMode) togglePause(state *appState) {
+	log.Println("toggling pause")
+	runIntegrationAction(state, "foobar.togglePause", 0, "")
+}
+
+func (foobarMode) stop(state *appState) {
+	log.Println("stopping playback")
+	runIntegrationAction(state, "foobar.stop", 0, "stop")
+}
+
+func (foobarMode) next(state *appState, cmdChan chan<- comm.Command) {
+	log.Println("playing next song")
+	runIntegrationAction(state, "foobar.next", 0, "next")
+}
+
+func (foobarMode) adjustVolume(state *appState, delta int) {
+	log.Printf("adjusting volume by %+d\n", delta)
+	runIntegrationAction(state, "foobar.volume", delta, "")
+}
+
+func (foobarMode) seek(state *appState, delta int) {
+	log.Printf("seeking %+d\n", delta)
+	runIntegrationAction(state, "foobar.seek", delta, "")
+}
+
+func (foobarMode) knobLED(state *appState) comm.Command {
+	return newCommandForFoobarState(state)
+}
+
+type tubeRemoteMode struct{}
+
+func (tubeRemoteMode) name() string {
+	return "youtube"
+}
+
+func (tubeRemoteMode) enabled(config *appConfig) bool {
+	_, ok := config.integration("tuberemote")
+	return ok
+}
+
+func (tubeRemoteMode) togglePause(state *appState) {
+	log.Println("toggling youtube pause")
+	runIntegrationAction(state, "tuberemote.togglePause", 0, "")
+}
+
+func (tubeRemoteMode) stop(state *appState) {
+	log.Println("stopping youtube")
+	runIntegrationAction(state, "tuberemote.stop", 0, "stop")
+}
+
+// youtube has no next track, so this goes back to the first mode
+func (tubeRemoteMode) next(state *appState, cmdChan chan<- comm.Command) {
+	setMode(state, cmdChan, 0)
+}
+
+func (tubeRemoteMode) adjustVolume(state *appState, delta int) {
+	log.Printf("adjusting youtube volume by %+d\n", delta)
+	runIntegrationAction(state, "tuberemote.volume", delta, "")
+}
+
+func (tubeRemoteMode) seek(state *appState, delta int) {
+	log.Printf("seeking %+d on youtube\n", delta)
+	runIntegrationAction(state, "tuberemote.seek", delta, "")
+}
+
+func (tubeRemoteMode) knobLED(state *appState) comm.Command {
+	return newCommandForTubeRemoteState(state)
+}
+
+// setMode activates the mode at index in the list of enabled modes. The
+// bottomLeft LED shows the color of the active mode unless it is the first one.
+func setMode(state *appState, cmdChan chan<- comm.Command, index int) {
+	state.modeIndex = index
+	m := state.mode()
+	state.recordStep("setMode:"+m.name(), 0)
+	log.Printf("switching to %s mode\n", m.name())
+	cmdChan <- state.toggleColorLED("bottomLeft", m.name(), index != 0)
+	cmdChan <- m.knobLED(state)
+}
+
+func cycleMode(state *appState, cmdChan chan<- comm.Command) {
+	if len(state.config.modes) < 2 {
+		log.Println("no other mode is enabled")
+		return
+	}
+	setMode(state, cmdChan, (state.modeIndex+1)%len(state.config.modes))
+}
+
+// toggleTubeMode switches to the youtube mode, or back to the first mode if it
+// is active. It predates cycleMode and is kept for existing keymaps.
+func toggleTubeMode(state *appState, cmdChan chan<- comm.Command) {
+	if state.modeActive("youtube") {
+		setMode(state, cmdChan, 0)
+		return
+	}
+	for i, m := range state.config.modes {
+		if m.name() == "youtube" {
+			setMode(state, cmdChan, i)
+			return
+		}
+	}
+	log.Println("youtube mode is not enabled")
+}
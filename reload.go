@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/thiefmaster/controller/comm"
+)
+
+// how often to check whether the config file has been modified
+const configPollInterval = 2 * time.Second
+
+// watchConfig reloads the config file on the main loop whenever it has been
+// modified or the process receives SIGHUP.
+func watchConfig(ctx context.Context, state *appState, cmdChan chan<- comm.Command, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	modTime := configModTime(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("received SIGHUP")
+		case <-ticker.C:
+			newModTime := configModTime(path)
+			if newModTime.Equal(modTime) {
+				continue
+			}
+			modTime = newModTime
+		}
+		state.post(ctx, func() {
+			reloadConfig(ctx, state, cmdChan, path)
+		})
+	}
+}
+
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		// a missing file is reported once it is loaded
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig replaces the config with the one from the config file and
+// restarts the integrations whose settings changed. If the new config is
+// invalid the current one is kept.
+func reloadConfig(ctx context.Context, state *appState, cmdChan chan<- comm.Command, path string) {
+	config := &appConfig{}
+	if err := config.load(path); err != nil {
+		log.Printf("keeping the current config: %v\n", err)
+		state.animator.play("error")
+		return
+	}
+	// the boards are connected already and everything uses their profile
+	if !sameHardware(config.Boards, state.config.Boards) {
+		log.Println("keeping the current config: boards cannot be changed without a restart")
+		state.animator.play("error")
+		return
+	}
+	if config.DebugPort != state.config.DebugPort {
+		log.Println("the debug port cannot be changed without a restart")
+	}
+	config.boards = state.config.boards
+	config.profile = state.config.profile
+
+	modeName := state.mode().name()
+	state.config = config
+	// buttons held while reloading are released with the new keymap
+	state.gestures.SetConfig(gestureConfig(config))
+	state.animator.setAnimations(config.animations)
+	state.modeIndex = 0
+	for i, m := range config.modes {
+		if m.name() == modeName {
+			state.modeIndex = i
+		}
+	}
+	updateBehavior(ctx, state)
+	if state.started {
+		renderAllLEDs(state, cmdChan)
+	}
+	log.Println("config reloaded")
+}
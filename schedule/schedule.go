@@ -0,0 +1,162 @@
+// Package schedule parses cron expressions and finds out when they last
+// matched.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is a cron expression with the fields minute, hour, day of month, month
+// and day of week. Fields are `*`, numbers, ranges like `1-5` and lists of
+// them like `1,3,5`, optionally with a step like `*/15`. Days of the week are
+// numbers from 0 (Sunday) to 7 (Sunday again) or names like `mon`.
+type Spec struct {
+	minute, hour, dom, month, dow uint64
+	// whether day of month and day of week are restricted; if both are, a
+	// day matches if either of them does
+	domRestricted, dowRestricted bool
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var fields = []field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// Parse parses a cron expression like `0 19 * * mon-fri`.
+func Parse(expr string) (Spec, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return Spec{}, fmt.Errorf("invalid cron expression %q: expected %d fields", expr, len(fields))
+	}
+	var bits [5]uint64
+	for i, part := range parts {
+		var err error
+		if bits[i], err = fields[i].parse(part); err != nil {
+			return Spec{}, fmt.Errorf("invalid cron expression %q: %v", expr, err)
+		}
+	}
+	// 7 is another name for Sunday
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return Spec{
+		minute:        bits[0],
+		hour:          bits[1],
+		dom:           bits[2],
+		month:         bits[3],
+		dow:           bits[4],
+		domRestricted: parts[2] != "*",
+		dowRestricted: parts[4] != "*",
+	}, nil
+}
+
+func (f field) parse(spec string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(spec, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepSpec); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s: %s", f.name, stepSpec)
+			}
+		}
+		first, last := f.min, f.max
+		if rangeSpec != "*" {
+			startSpec, endSpec, isRange := strings.Cut(rangeSpec, "-")
+			var err error
+			if first, err = f.value(startSpec); err != nil {
+				return 0, err
+			}
+			last = first
+			if isRange {
+				if last, err = f.value(endSpec); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				last = f.max
+			}
+			if last < first {
+				return 0, fmt.Errorf("invalid range in %s: %s", f.name, rangeSpec)
+			}
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (f field) value(spec string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(spec, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(spec)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s: %s", f.name, spec)
+	}
+	return v, nil
+}
+
+// matchesDay tells whether the expression matches any time on the day of t.
+func (s Spec) matchesDay(t time.Time) bool {
+	if s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Matches tells whether the expression matches the minute of t.
+func (s Spec) Matches(t time.Time) bool {
+	return s.matchesDay(t) && s.hour&(1<<t.Hour()) != 0 && s.minute&(1<<t.Minute()) != 0
+}
+
+// Prev returns the latest minute at or before t matched by the expression.
+// It only looks back one year and returns false if there is no such minute.
+func (s Spec) Prev(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i <= 366; i++ {
+		if s.matchesDay(day) {
+			lastHour, lastMinute := 23, 59
+			if i == 0 {
+				lastHour, lastMinute = t.Hour(), t.Minute()
+			}
+			for hour := lastHour; hour >= 0; hour-- {
+				if s.hour&(1<<hour) == 0 {
+					continue
+				}
+				minute := 59
+				if hour == lastHour {
+					minute = lastMinute
+				}
+				for ; minute >= 0; minute-- {
+					if s.minute&(1<<minute) != 0 {
+						return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, day.Location()), true
+					}
+				}
+			}
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,104 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// date returns a time in UTC; 2024-01-01 is a Monday.
+func date(month time.Month, day, hour, minute int) time.Time {
+	return time.Date(2024, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "* * * * *"},
+		{expr: "0 19 * * mon-fri"},
+		{expr: "*/15 0-6,22,23 1 jan,Dec 7"},
+		{expr: "5-30/5 * * * *"},
+		{expr: "* * *", wantErr: true},
+		{expr: "* * * * * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "* * * * fri-mon", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "* * * foo *", wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.expr); (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want an error: %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", date(1, 1, 12, 34), true},
+		{"0 19 * * mon-fri", date(1, 1, 19, 0), true},
+		{"0 19 * * mon-fri", date(1, 1, 19, 1), false},
+		{"0 19 * * mon-fri", date(1, 6, 19, 0), false},
+		{"*/15 * * * *", date(1, 1, 3, 45), true},
+		{"*/15 * * * *", date(1, 1, 3, 50), false},
+		{"5-30/5 * * * *", date(1, 1, 3, 25), true},
+		{"5-30/5 * * * *", date(1, 1, 3, 35), false},
+		{"0 7 * * sat,sun", date(1, 7, 7, 0), true},
+		// 7 is Sunday as well
+		{"0 7 * * 7", date(1, 7, 7, 0), true},
+		{"0 0 1 jan *", date(1, 1, 0, 0), true},
+		{"0 0 1 jan *", date(2, 1, 0, 0), false},
+		// day of month or day of week if both are restricted
+		{"0 0 15 * fri", date(1, 5, 0, 0), true},
+		{"0 0 15 * fri", date(1, 15, 0, 0), true},
+		{"0 0 15 * fri", date(1, 16, 0, 0), false},
+		// day of month and day of week if only one is restricted
+		{"0 0 15 * *", date(1, 5, 0, 0), false},
+	}
+	for _, tt := range tests {
+		spec, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := spec.Matches(tt.t); got != tt.want {
+			t.Errorf("%q at %v: got %v, want %v", tt.expr, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestPrev(t *testing.T) {
+	tests := []struct {
+		expr string
+		t    time.Time
+		want time.Time
+	}{
+		{"0 19 * * *", date(1, 2, 20, 30), date(1, 2, 19, 0)},
+		// matching the current minute
+		{"0 19 * * *", date(1, 2, 19, 0).Add(30 * time.Second), date(1, 2, 19, 0)},
+		{"0 19 * * *", date(1, 2, 18, 59), date(1, 1, 19, 0)},
+		{"0 7 * * mon-fri", date(1, 7, 12, 0), date(1, 5, 7, 0)},
+		{"*/15 * * * *", date(1, 2, 10, 14), date(1, 2, 10, 0)},
+		{"30 * * * *", date(1, 2, 0, 10), date(1, 1, 23, 30)},
+		{"0 0 1 jan *", date(6, 15, 0, 0), date(1, 1, 0, 0)},
+		// February 30th never happens
+		{"0 0 30 feb *", date(6, 15, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		spec, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := spec.Prev(tt.t)
+		if ok != !tt.want.IsZero() || !got.Equal(tt.want) {
+			t.Errorf("%q before %v: got %v, %v, want %v", tt.expr, tt.t, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/thiefmaster/controller/comm"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// how long a script may run unless its settings specify a different timeout
+const defaultScriptTimeout = 1 * time.Second
+
+type scriptSettings struct {
+	Source  string
+	Timeout time.Duration
+}
+
+// script is a Starlark program from the `scripts` section of the config file
+// that can be bound to gestures like any other action.
+type script struct {
+	name    string
+	program *starlark.Program
+	timeout time.Duration
+}
+
+// names available to scripts besides the Starlark builtins
+var scriptGlobals = []string{"state", "value", "run", "led", "play"}
+
+var scriptFileOptions = &syntax.FileOptions{
+	// scripts are short, so they do not have to put everything in functions
+	TopLevelControl: true,
+	GlobalReassign:  true,
+}
+
+func loadScript(name string, settings scriptSettings) (*script, error) {
+	if strings.Contains(name, ".") {
+		return nil, fmt.Errorf("invalid script name: %s", name)
+	}
+	if _, ok := actionRegistry[name]; ok {
+		return nil, fmt.Errorf("script %s has the name of an action", name)
+	}
+	if settings.Timeout < 0 {
+		return nil, fmt.Errorf("script %s: invalid timeout: %v", name, settings.Timeout)
+	}
+	_, program, err := starlark.SourceProgramOptions(scriptFileOptions, name, settings.Source, func(name string) bool {
+		for _, global := range scriptGlobals {
+			if name == global {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %v", name, err)
+	}
+	timeout := settings.Timeout
+	if timeout == 0 {
+		timeout = defaultScriptTimeout
+	}
+	return &script{name: name, program: program, timeout: timeout}, nil
+}
+
+// scriptEffect is something a script wants to do. Effects are applied on the
+// main loop once the script has finished.
+type scriptEffect func(state *appState, cmdChan chan<- comm.Command)
+
+// runScript runs a script in the background with a snapshot of the state and
+// applies its effects once it succeeded. Scripts which fail or exceed their
+// timeout have no effect at all.
+func runScript(state *appState, cmdChan chan<- comm.Command, s *script, value int) {
+	config := state.config
+	var effects []scriptEffect
+	predeclared := starlark.StringDict{
+		"state": scriptState(state),
+		"value": starlark.MakeInt(value),
+		"run": starlark.NewBuiltin("run", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			var value int
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "action", &name, "value?", &value); err != nil {
+				return nil, err
+			}
+			if _, ok := config.scripts[name]; ok {
+				return nil, fmt.Errorf("%s: scripts cannot run other scripts", b.Name())
+			}
+			a, ok := config.findAction(name)
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown action: %s", b.Name(), name)
+			}
+			effects = append(effects, func(state *appState, cmdChan chan<- comm.Command) {
+				a.run(state, cmdChan, value)
+			})
+			return starlark.None, nil
+		}),
+		"led": starlark.NewBuiltin("led", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name, color string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "led", &name, "color", &color); err != nil {
+				return nil, err
+			}
+			if _, ok := config.profile.LED(name); !ok {
+				return nil, fmt.Errorf("%s: unknown led: %s", b.Name(), name)
+			}
+			if err := validateFrameColor(color); err != nil || color == "toggle" {
+				return nil, fmt.Errorf("%s: invalid color: %s", b.Name(), color)
+			}
+			effects = append(effects, func(state *appState, cmdChan chan<- comm.Command) {
+				state.scriptLEDs <- ledCommand(state.profile, name, color)
+			})
+			return starlark.None, nil
+		}),
+		"play": starlark.NewBuiltin("play", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "animation", &name); err != nil {
+				return nil, err
+			}
+			if _, ok := config.animations[name]; !ok {
+				return nil, fmt.Errorf("%s: unknown animation: %s", b.Name(), name)
+			}
+			effects = append(effects, func(state *appState, cmdChan chan<- comm.Command) {
+				state.animator.play(name)
+			})
+			return starlark.None, nil
+		}),
+	}
+
+	go func() {
+		thread := &starlark.Thread{
+			Name: s.name,
+			Print: func(thread *starlark.Thread, msg string) {
+				log.Printf("script %s: %s\n", s.name, msg)
+			},
+		}
+		timer := time.AfterFunc(s.timeout, func() {
+			thread.Cancel(fmt.Sprintf("timed out after %v", s.timeout))
+		})
+		_, err := s.program.Init(thread, predeclared)
+		timer.Stop()
+		state.post(state.ctx, func() {
+			if err != nil {
+				log.Printf("script %s failed: %v\n", s.name, err)
+				state.animator.play("error")
+				return
+			}
+			for _, effect := range effects {
+				effect(state, cmdChan)
+			}
+		})
+	}()
+}
+
+// scriptState returns what scripts can see of the state. It is a snapshot
+// since scripts do not run on the main loop.
+func scriptState(state *appState) *starlarkstruct.Struct {
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"desktopLocked": starlark.Bool(state.desktopLocked),
+		"monitorsOn":    starlark.Bool(state.monitorsOn),
+		"mode":          starlark.String(state.mode().name()),
+		"dnd":           starlark.Bool(state.dnd != nil),
+		"foobar": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"state":  starlark.String(state.foobarState.State),
+			"volume": starlark.Float(state.foobarState.Volume.Current),
+		}),
+		"youtube": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"state":  starlark.String(state.tubeRemoteState.State),
+			"volume": starlark.MakeInt(state.tubeRemoteState.Volume),
+		}),
+		"nothub": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"highlights":      starlark.Bool(state.notHubState.ChanHL),
+			"messages":        starlark.Bool(state.notHubState.ChanMsg),
+			"commits":         starlark.Bool(state.notHubState.Commit),
+			"privateMessages": starlark.Bool(state.notHubState.PrivMsg),
+		}),
+		"mattermost": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"messages": starlark.Bool(state.mattermostState.HasMessages),
+			"mentions": starlark.Bool(state.mattermostState.HasMentions),
+		}),
+	})
+}